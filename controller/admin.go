@@ -2,46 +2,118 @@ package controller
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"mime"
 	"net/http"
+	"strconv"
 
+	"github.com/shashankk204/load_balancer/middleware"
 	core "github.com/shashankk204/load_balancer/pkg"
 	"github.com/shashankk204/load_balancer/utils"
 )
 
-
 type AdminHandler struct {
 	LB *core.LoadBalancer
 }
 
 func (a *AdminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet && !middleware.IdentityFrom(r.Context()).CanRead() {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
 	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/admin/add-route":
+		a.handleAddRoute(w, r)
 	case r.Method == http.MethodPost && r.URL.Path == "/admin/add-backend":
 		a.handleAddBackend(w, r)
 	case r.Method == http.MethodPost && r.URL.Path == "/admin/remove-backend":
 		a.handleRemoveBackend(w, r)
+	case r.Method == http.MethodPost && r.URL.Path == "/admin/drain":
+		a.handleDrain(w, r)
+	case r.Method == http.MethodPost && r.URL.Path == "/admin/undrain":
+		a.handleUndrain(w, r)
 	case r.Method == http.MethodGet && r.URL.Path == "/admin/list":
 		a.handleListRoutes(w, r)
 	case r.Method == http.MethodPut && r.URL.Path == "/admin/update":
 		a.handleUpdateRoute(w, r)
+	case r.Method == http.MethodPost && r.URL.Path == "/admin/set-weight":
+		a.handleSetWeight(w, r)
+	case r.Method == http.MethodPost && r.URL.Path == "/admin/set-split":
+		a.handleSetSplit(w, r)
+	case r.Method == http.MethodPost && r.URL.Path == "/admin/ramp-canary":
+		a.handleRampCanary(w, r)
+	case r.Method == http.MethodGet && r.URL.Path == "/admin/config":
+		a.handleGetConfig(w, r)
+	case r.Method == http.MethodPost && r.URL.Path == "/admin/config":
+		a.handleReplaceConfig(w, r)
+	case r.Method == http.MethodGet && r.URL.Path == "/admin/events":
+		a.handleEvents(w, r)
+	case r.Method == http.MethodGet && r.URL.Path == "/admin/history":
+		a.handleHistory(w, r)
+	case r.Method == http.MethodPost && r.URL.Path == "/admin/rollback":
+		a.handleRollback(w, r)
 	default:
 		http.Error(w, "Unknown or unsupported admin endpoint", http.StatusNotFound)
 	}
 }
 
+func (a *AdminHandler) handleAddRoute(w http.ResponseWriter, r *http.Request) {
+	var req core.RouteConfig
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if req.Prefix == "" || len(req.Backends) == 0 {
+		http.Error(w, "prefix and backends are required", http.StatusBadRequest)
+		return
+	}
+	if !a.allowed(w, r, req.Prefix) {
+		return
+	}
+	version, ok := a.change(w, r, "add-route", "add route", http.StatusBadRequest, func() error {
+		_, err := a.LB.AddRouteConfig(req)
+		return err
+	})
+	if !ok {
+		return
+	}
+	utils.RespondJSON(w, http.StatusOK, map[string]interface{}{
+		"status":   "success",
+		"action":   "add-route",
+		"route":    req.Key(),
+		"prefix":   req.Prefix,
+		"strategy": core.ParseStrategy(req.Strategy),
+		"version":  version,
+	})
+}
+
 func (a *AdminHandler) handleAddBackend(w http.ResponseWriter, r *http.Request) {
 	var req struct {
-		Prefix string `json:"prefix"`
-		URL    string `json:"url"`
-		Strategy string   `json:"strategy,omitempty"`
+		Prefix   string              `json:"prefix"`
+		URL      string              `json:"url"`
+		Weight   int                 `json:"weight,omitempty"`
+		Strategy string              `json:"strategy,omitempty"`
+		Timeouts *core.TimeoutConfig `json:"timeouts,omitempty"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "Invalid request", http.StatusBadRequest)
 		return
 	}
-	strategy := core.ParseStrategy(req.Strategy)
-	if err := a.LB.AddBackendToRoute(req.Prefix, req.URL,strategy); err != nil {
-		http.Error(w, "Failed to add backend", http.StatusInternalServerError)
+	if !a.allowed(w, r, a.LB.RoutePrefix(req.Prefix)) {
+		return
+	}
+	strategy, ok := core.LookupStrategy(req.Strategy)
+	if !ok {
+		http.Error(w, fmt.Sprintf("Unknown strategy %q", req.Strategy), http.StatusBadRequest)
+		return
+	}
+	backend := core.BackendConfig{URL: req.URL, Weight: req.Weight, Timeouts: req.Timeouts}
+	version, ok := a.change(w, r, "add-backend", "add backend", http.StatusBadRequest, func() error {
+		return a.LB.AddBackendToRoute(req.Prefix, backend, strategy)
+	})
+	if !ok {
 		return
 	}
 	utils.RespondJSON(w, http.StatusOK, map[string]interface{}{
@@ -49,7 +121,9 @@ func (a *AdminHandler) handleAddBackend(w http.ResponseWriter, r *http.Request)
 		"action":   "add-backend",
 		"prefix":   req.Prefix,
 		"url":      req.URL,
+		"weight":   max(req.Weight, 1),
 		"strategy": strategy,
+		"version":  version,
 	})
 }
 
@@ -62,16 +136,77 @@ func (a *AdminHandler) handleRemoveBackend(w http.ResponseWriter, r *http.Reques
 		http.Error(w, "Invalid request", http.StatusBadRequest)
 		return
 	}
-	a.LB.RemoveBackendFromRoute(req.Prefix, req.URL)
+	if !a.allowed(w, r, a.LB.RoutePrefix(req.Prefix)) {
+		return
+	}
+	version, ok := a.change(w, r, "remove-backend", "remove backend", http.StatusNotFound, func() error {
+		return a.LB.RemoveBackendFromRoute(req.Prefix, req.URL)
+	})
+	if !ok {
+		return
+	}
+	utils.RespondJSON(w, http.StatusOK, map[string]interface{}{
+		"status":  "success",
+		"action":  "remove-backend",
+		"prefix":  req.Prefix,
+		"url":     req.URL,
+		"version": version,
+	})
+}
+
+// handleDrain takes a backend out of rotation without cutting off its
+// in-flight requests. Progress shows up in /admin/list.
+func (a *AdminHandler) handleDrain(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Prefix string `json:"prefix"`
+		URL    string `json:"url"`
+		core.DrainOptions
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if !a.allowed(w, r, a.LB.RoutePrefix(req.Prefix)) {
+		return
+	}
+	if err := a.LB.DrainBackend(req.Prefix, req.URL, req.DrainOptions, author(r)); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to drain backend: %v", err), http.StatusBadRequest)
+		return
+	}
+	utils.RespondJSON(w, http.StatusOK, map[string]interface{}{
+		"status":  "success",
+		"action":  "drain",
+		"prefix":  req.Prefix,
+		"url":     req.URL,
+		"remove":  req.Remove,
+		"timeout": req.Timeout,
+	})
+}
+
+func (a *AdminHandler) handleUndrain(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Prefix string `json:"prefix"`
+		URL    string `json:"url"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if !a.allowed(w, r, a.LB.RoutePrefix(req.Prefix)) {
+		return
+	}
+	if err := a.LB.UndrainBackend(req.Prefix, req.URL); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to undrain backend: %v", err), http.StatusBadRequest)
+		return
+	}
 	utils.RespondJSON(w, http.StatusOK, map[string]interface{}{
 		"status": "success",
-		"action": "remove-backend",
+		"action": "undrain",
 		"prefix": req.Prefix,
 		"url":    req.URL,
 	})
 }
 
-
 func (a *AdminHandler) handleListRoutes(w http.ResponseWriter, _ *http.Request) {
 	routes := a.LB.GetRoutesInfo()
 	utils.RespondJSON(w, http.StatusOK, routes)
@@ -79,17 +214,22 @@ func (a *AdminHandler) handleListRoutes(w http.ResponseWriter, _ *http.Request)
 
 func (a *AdminHandler) handleUpdateRoute(w http.ResponseWriter, r *http.Request) {
 	var req struct {
-		Prefix   string   `json:"prefix"`
-		Backends []string `json:"backends,omitempty"`
-		Strategy string   `json:"strategy,omitempty"`
+		Prefix   string               `json:"prefix"`
+		Backends []core.BackendConfig `json:"backends,omitempty"`
+		Strategy string               `json:"strategy,omitempty"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "Invalid JSON", http.StatusBadRequest)
 		return
 	}
 
-	if err := a.LB.UpdateRoute(req.Prefix, req.Backends, req.Strategy); err != nil {
-		http.Error(w, fmt.Sprintf("Failed to update route: %v", err), http.StatusInternalServerError)
+	if !a.allowed(w, r, a.LB.RoutePrefix(req.Prefix)) {
+		return
+	}
+	version, ok := a.change(w, r, "update-route", "update route", http.StatusBadRequest, func() error {
+		return a.LB.UpdateRoute(req.Prefix, req.Backends, req.Strategy)
+	})
+	if !ok {
 		return
 	}
 
@@ -98,5 +238,250 @@ func (a *AdminHandler) handleUpdateRoute(w http.ResponseWriter, r *http.Request)
 		"action":   "update-route",
 		"prefix":   req.Prefix,
 		"strategy": req.Strategy,
+		"version":  version,
+	})
+}
+
+func (a *AdminHandler) handleSetWeight(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Prefix string `json:"prefix"`
+		URL    string `json:"url"`
+		Weight int    `json:"weight"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	if !a.allowed(w, r, a.LB.RoutePrefix(req.Prefix)) {
+		return
+	}
+	version, ok := a.change(w, r, "set-weight", "set weight", http.StatusBadRequest, func() error {
+		return a.LB.SetBackendWeight(req.Prefix, req.URL, req.Weight)
+	})
+	if !ok {
+		return
+	}
+
+	utils.RespondJSON(w, http.StatusOK, map[string]interface{}{
+		"status":  "success",
+		"action":  "set-weight",
+		"prefix":  req.Prefix,
+		"url":     req.URL,
+		"weight":  req.Weight,
+		"version": version,
+	})
+}
+
+func (a *AdminHandler) handleSetSplit(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Prefix  string `json:"prefix"`
+		Group   string `json:"group"`
+		Percent int    `json:"percent"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	if !a.allowed(w, r, a.LB.RoutePrefix(req.Prefix)) {
+		return
+	}
+	version, ok := a.change(w, r, "set-split", "set split", http.StatusBadRequest, func() error {
+		return a.LB.SetGroupPercent(req.Prefix, req.Group, req.Percent)
+	})
+	if !ok {
+		return
+	}
+
+	utils.RespondJSON(w, http.StatusOK, map[string]interface{}{
+		"status":  "success",
+		"action":  "set-split",
+		"prefix":  req.Prefix,
+		"group":   req.Group,
+		"percent": req.Percent,
+		"version": version,
+	})
+}
+
+func (a *AdminHandler) handleRampCanary(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Prefix string `json:"prefix"`
+		core.CanaryRamp
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	if !a.allowed(w, r, a.LB.RoutePrefix(req.Prefix)) {
+		return
+	}
+	version, ok := a.change(w, r, "ramp-canary", "start canary ramp", http.StatusBadRequest, func() error {
+		return a.LB.StartCanaryRamp(req.Prefix, req.CanaryRamp)
+	})
+	if !ok {
+		return
+	}
+
+	utils.RespondJSON(w, http.StatusOK, map[string]interface{}{
+		"status":  "success",
+		"action":  "ramp-canary",
+		"prefix":  req.Prefix,
+		"group":   req.Group,
+		"version": version,
+	})
+}
+
+func (a *AdminHandler) handleGetConfig(w http.ResponseWriter, _ *http.Request) {
+	utils.RespondJSON(w, http.StatusOK, a.LB.Config())
+}
+
+// handleReplaceConfig swaps the whole configuration, as a file reload would.
+// A non-zero version must match the running one, so a client cannot
+// overwrite changes it has not seen.
+func (a *AdminHandler) handleReplaceConfig(w http.ResponseWriter, r *http.Request) {
+	if !a.allowed(w, r, "") {
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		return
+	}
+	cfg, err := core.ParseConfig(body, configFormat(r.Header.Get("Content-Type")))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid config: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	var result *core.ReloadResult
+	version, ok := a.change(w, r, "replace-config", "replace config", http.StatusBadRequest, func() error {
+		result, err = a.LB.ApplyConfig(cfg, cfg.Version)
+		return err
+	})
+	if !ok {
+		return
+	}
+
+	utils.RespondJSON(w, http.StatusOK, map[string]interface{}{
+		"status":  "success",
+		"action":  "replace-config",
+		"routes":  result,
+		"version": version,
+	})
+}
+
+// change applies fn and records it in the history as one step, so that
+// concurrent admin calls each get a version of their own with the right
+// author. When fn fails nothing is recorded and the request is answered with
+// status, or 404 and 409 for unknown routes and stale versions. A change that
+// is applied but not recorded is answered with 500.
+func (a *AdminHandler) change(w http.ResponseWriter, r *http.Request, action, what string, status int, fn func() error) (int64, bool) {
+	version, err := a.LB.Change(author(r), action, fn)
+	var persistErr *core.PersistError
+	var conflict *core.VersionConflictError
+	switch {
+	case err == nil:
+		return version, true
+	case errors.As(err, &persistErr):
+		http.Error(w, fmt.Sprintf("Failed to persist config: %v", err), http.StatusInternalServerError)
+		return 0, false
+	case errors.As(err, &conflict):
+		status = http.StatusConflict
+	case errors.Is(err, core.ErrRouteNotFound), errors.Is(err, core.ErrBackendNotFound):
+		status = http.StatusNotFound
+	}
+	http.Error(w, fmt.Sprintf("Failed to %s: %v", what, err), status)
+	return 0, false
+}
+
+// configFormat maps a request Content-Type to a config format, JSON unless
+// it names YAML or TOML.
+func configFormat(contentType string) string {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch mediaType {
+	case "application/yaml", "application/x-yaml", "text/yaml":
+		return "yaml"
+	case "application/toml":
+		return "toml"
+	default:
+		return "json"
+	}
+}
+
+// allowed checks that the caller may change the route with prefix, or the
+// whole config if prefix is empty, and answers 403 if not.
+func (a *AdminHandler) allowed(w http.ResponseWriter, r *http.Request, prefix string) bool {
+	if !middleware.IdentityFrom(r.Context()).CanMutate(prefix) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// author names who made a change: the authenticated caller, else the
+// X-Admin-User header if set, else the client address.
+func author(r *http.Request) string {
+	if id := middleware.IdentityFrom(r.Context()); id != nil && id.Method != "none" {
+		return id.Method + ":" + id.Name
+	}
+	if user := r.Header.Get("X-Admin-User"); user != "" {
+		return user
+	}
+	return r.RemoteAddr
+}
+
+func (a *AdminHandler) handleHistory(w http.ResponseWriter, r *http.Request) {
+	history := a.LB.History()
+	if v := r.URL.Query().Get("version"); v != "" {
+		version, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			http.Error(w, "version must be a number", http.StatusBadRequest)
+			return
+		}
+		snapshot, ok := history.Get(version)
+		if !ok {
+			http.Error(w, fmt.Sprintf("Version %d is not in the history", version), http.StatusNotFound)
+			return
+		}
+		utils.RespondJSON(w, http.StatusOK, snapshot)
+		return
+	}
+	utils.RespondJSON(w, http.StatusOK, map[string]interface{}{
+		"version": a.LB.ConfigVersion(),
+		"history": history.List(),
+	})
+}
+
+func (a *AdminHandler) handleRollback(w http.ResponseWriter, r *http.Request) {
+	if !a.allowed(w, r, "") {
+		return
+	}
+	target, err := strconv.ParseInt(r.URL.Query().Get("version"), 10, 64)
+	if err != nil {
+		http.Error(w, "version query parameter is required", http.StatusBadRequest)
+		return
+	}
+	if _, ok := a.LB.History().Get(target); !ok {
+		http.Error(w, fmt.Sprintf("Version %d is not in the history", target), http.StatusNotFound)
+		return
+	}
+	result, version, err := a.LB.Rollback(target, author(r))
+	if result == nil {
+		http.Error(w, fmt.Sprintf("Failed to roll back: %v", err), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to persist config: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	utils.RespondJSON(w, http.StatusOK, map[string]interface{}{
+		"status":      "success",
+		"action":      "rollback",
+		"rolled_back": target,
+		"routes":      result,
+		"version":     version,
 	})
-}
\ No newline at end of file
+}
@@ -0,0 +1,101 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	core "github.com/shashankk204/load_balancer/pkg"
+	"github.com/shashankk204/load_balancer/utils"
+)
+
+// sseKeepAlive is how often an idle event stream gets a comment line, so
+// that proxies in between do not time it out.
+const sseKeepAlive = 15 * time.Second
+
+// handleEvents lists recent backend UP/DOWN transitions, oldest first. With
+// Accept: text/event-stream it streams them instead, starting after the
+// Last-Event-ID a reconnecting client sends.
+func (a *AdminHandler) handleEvents(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	route, backend := query.Get("route"), query.Get("backend")
+	match := func(ev core.HealthEvent) bool {
+		return (route == "" || ev.Route == route) && (backend == "" || ev.Backend == backend)
+	}
+
+	since := query.Get("since")
+	if id := r.Header.Get("Last-Event-ID"); id != "" {
+		since = id
+	}
+	var after int64
+	if since != "" {
+		var err error
+		if after, err = strconv.ParseInt(since, 10, 64); err != nil {
+			http.Error(w, "since must be an event id", http.StatusBadRequest)
+			return
+		}
+	}
+
+	events := a.LB.HealthEvents()
+	if !strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		list := []core.HealthEvent{}
+		for _, ev := range events.Since(after) {
+			if match(ev) {
+				list = append(list, ev)
+			}
+		}
+		utils.RespondJSON(w, http.StatusOK, list)
+		return
+	}
+
+	// Subscribe before replaying, so nothing falls between the two.
+	live, cancel := events.Subscribe()
+	defer cancel()
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	send := func(ev core.HealthEvent) bool {
+		if ev.ID <= after || !match(ev) {
+			return true
+		}
+		after = ev.ID
+		data, _ := json.Marshal(ev)
+		if _, err := fmt.Fprintf(w, "id: %d\nevent: health\ndata: %s\n\n", ev.ID, data); err != nil {
+			return false
+		}
+		return rc.Flush() == nil
+	}
+	for _, ev := range events.Since(after) {
+		if !send(ev) {
+			return
+		}
+	}
+	if rc.Flush() != nil {
+		return
+	}
+
+	ticker := time.NewTicker(sseKeepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case ev, ok := <-live:
+			if !ok {
+				return // shutting down
+			}
+			if !send(ev) {
+				return
+			}
+		case <-ticker.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil || rc.Flush() != nil {
+				return
+			}
+		}
+	}
+}
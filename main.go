@@ -1,75 +1,198 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/shashankk204/load_balancer/middleware"
 	core "github.com/shashankk204/load_balancer/pkg"
+	"github.com/shashankk204/load_balancer/pkg/logger"
 
 	controller "github.com/shashankk204/load_balancer/controller"
 
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
-type RouteConfig struct {
-	Prefix   string   `json:"prefix"`
-	Backends []string `json:"backends"`
-	Strategy string   `json:"strategy,omitempty"`
-}
-
-type Config struct {
-	Routes []RouteConfig `json:"routes"`
-}
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "validate" {
+		os.Exit(validate(os.Args[2:]))
+	}
+	settings, err := core.LoadSettings(os.Args[1:], os.Getenv)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	settings.Print(os.Stdout)
+	logger.Configure(settings.Log.Level, settings.Log.Format)
 
-func LoadConfig(path string) (*Config, error) {
-	data, err := os.ReadFile(path)
+	core.InitMetrics()
+	lb := core.Initialize_LB()
+	if settings.Persist.Path != "" {
+		lb.EnablePersistence(settings.Persist.Path)
+	}
+	history, err := core.NewConfigHistory(settings.History.Dir, settings.History.Limit)
 	if err != nil {
-		return nil, err
+		log.Fatal(err)
+	}
+	lb.SetHistory(history)
+	if settings.Webhooks.Config != "" {
+		cfg, err := core.LoadWebhookConfig(settings.Webhooks.Config)
+		if err != nil {
+			log.Fatal(err)
+		}
+		lb.EnableWebhooks(cfg)
+	}
+	if _, err := lb.ReloadConfig(core.StartupConfigPath(settings.Config, settings.Persist.Path)); err != nil {
+		log.Fatal(err)
 	}
-	var cfg Config
-	err = json.Unmarshal(data, &cfg)
-	return &cfg, err
-}
 
+	background, stopBackground := context.WithCancel(context.Background())
+	go lb.WatchConfig(background, settings.Config, time.Duration(settings.WatchInterval))
+	lb.StartHealthChecks(background, settings.Health)
 
+	adminHandler := &controller.AdminHandler{LB: lb}
+	servers := []*http.Server{newAdminServer(settings.Admin.Listen, settings.Admin.Config, adminHandler)}
+
+	var handler http.Handler = lb
+	if settings.RateLimit.Rate > 0 {
+		rl := middleware.NewRateLimiter(settings.RateLimit.Rate, settings.RateLimit.Burst)
+		rl.Reject = func(w http.ResponseWriter, r *http.Request) {
+			lb.WriteError(w, r, http.StatusTooManyRequests, "Too many requests, slow down")
+		}
+		handler = middleware.RateLimitMiddleware(rl, lb)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/", handler)
+	if settings.Metrics.Enabled {
+		if settings.Metrics.Listen == "" {
+			mux.Handle(settings.Metrics.Path, promhttp.Handler())
+		} else {
+			servers = append(servers, newMetricsServer(settings.Metrics.Listen, settings.Metrics.Path))
+		}
+	}
+	// mux.HandleFunc("/metrics2", lb.MetricsHandler)
 
+	signals, stopSignals := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stopSignals()
 
+	servers = append(servers, &http.Server{Addr: settings.Listen, Handler: mux})
+	for _, server := range servers {
+		go serve(server)
+	}
+	fmt.Println("Load Balancer started at " + settings.Listen)
 
+	<-signals.Done()
+	stopSignals() // a second signal kills the process
+	shutdown(lb, time.Duration(settings.ShutdownTimeout), servers)
+	stopBackground()
+	logger.Flush()
+}
 
-func main() {
-	core.InitMetrics();
-	lb:=core.Initialize_LB()
-	rl := middleware.NewRateLimiter(5,10)
-	cfg, err := LoadConfig("routes.json")
-	if err != nil {
+func serve(server *http.Server) {
+	var err error
+	if server.TLSConfig != nil {
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		err = server.ListenAndServe()
+	}
+	if !errors.Is(err, http.ErrServerClosed) {
 		log.Fatal(err)
 	}
+}
 
-
-	for _, r := range cfg.Routes {
-		strategy := core.ParseStrategy(r.Strategy)
-		lb.AddRoute(r.Prefix, r.Backends,strategy)
+// shutdown stops the servers accepting connections and gives in-flight
+// requests until timeout to finish. Requests still running then are cut off.
+func shutdown(lb *core.LoadBalancer, timeout time.Duration, servers []*http.Server) {
+	start := time.Now()
+	lb.HealthEvents().Close() // end event streams, they never go idle
+	log.Printf("Shutting down, waiting up to %s for %d in-flight requests", timeout, lb.ActiveRequests())
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, server := range servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			server.Shutdown(ctx)
+		}()
+	}
+	wg.Wait()
+	// Shutdown does not wait for hijacked connections such as WebSockets.
+	cutOff := lb.WaitIdle(ctx)
+	for _, server := range servers {
+		server.Close()
 	}
+	lb.CloseWebhooks(ctx)
 
-	go lb.StartHealthChecks(5*time.Second, "/health")
- 
-	adminHandler := &controller.AdminHandler{LB: lb}
+	fields := map[string]string{"duration": time.Since(start).String()}
+	if cutOff > 0 {
+		fields["error"] = fmt.Sprintf("%d in-flight requests cut off after %s", cutOff, timeout)
+		logger.Error(context.Background(), "Shutdown timed out", fields)
+		return
+	}
+	logger.Info(context.Background(), "Shutdown complete", fields)
+}
 
-	mux := http.NewServeMux()
-	mux.Handle("/", middleware.RateLimitMiddleware(rl, lb))               
-	mux.Handle("/admin/", adminHandler)   
-	mux.Handle("/metrics", promhttp.Handler())
-	// mux.HandleFunc("/metrics2", lb.MetricsHandler)
+// newAdminServer sets up the admin API on its own listener. configPath names
+// a file with TLS settings and credentials; without it the API is
+// unauthenticated, so it should stay on localhost.
+func newAdminServer(addr, configPath string, handler http.Handler) *http.Server {
+	server := &http.Server{Addr: addr}
+	var auth *middleware.AdminAuth
+	if configPath != "" {
+		cfg, err := middleware.LoadAdminConfig(configPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if auth, err = middleware.NewAdminAuth(cfg); err != nil {
+			log.Fatalf("%s: %v", configPath, err)
+		}
+		if server.TLSConfig, err = cfg.ServerTLS(); err != nil {
+			log.Fatalf("%s: %v", configPath, err)
+		}
+	}
+	if auth == nil {
+		log.Printf("Admin API on %s has no authentication, set admin.config to enable it", server.Addr)
+	}
+	server.Handler = middleware.AdminAuthMiddleware(auth, handler)
 
+	fmt.Println("Admin API started at " + server.Addr)
+	return server
+}
 
+func newMetricsServer(addr, path string) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle(path, promhttp.Handler())
+	fmt.Println("Metrics served at " + addr + path)
+	return &http.Server{Addr: addr, Handler: mux}
+}
 
-	fmt.Println("Load Balancer started at :8080")
-	if err := http.ListenAndServe(":8080", mux); err != nil {
-		log.Fatal(err)
+// validate checks config files without starting the server and returns the
+// exit code: 0 if all are valid, 1 otherwise.
+func validate(paths []string) int {
+	if len(paths) == 0 {
+		paths = []string{"routes.json"}
 	}
-}
\ No newline at end of file
+	code := 0
+	for _, path := range paths {
+		if _, err := core.LoadConfig(path); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			code = 1
+			continue
+		}
+		fmt.Printf("%s: OK\n", path)
+	}
+	return code
+}
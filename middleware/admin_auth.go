@@ -0,0 +1,461 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	core "github.com/shashankk204/load_balancer/pkg"
+	"github.com/shashankk204/load_balancer/pkg/logger"
+)
+
+const (
+	defaultHMACMaxSkew = 5 * time.Minute
+	maxAdminBodyBytes  = 10 << 20 // 10 MiB, read before a signature is checked
+
+	// Headers of an HMAC-signed admin request.
+	HeaderHMACKey       = "X-LB-Key"
+	HeaderHMACTimestamp = "X-LB-Timestamp"
+	HeaderHMACSignature = "X-LB-Signature"
+	HeaderHMACNonce     = "X-LB-Nonce"
+
+	maxHMACNonceLength = 128
+)
+
+// AdminConfig is the TLS setup and access control of the admin API, read
+// from a file of its own so that credentials never show up in the routes
+// config.
+type AdminConfig struct {
+	TLS *AdminTLSConfig `json:"tls,omitempty"`
+
+	Roles       map[string]AdminRole `json:"roles"`
+	Tokens      []TokenCredential    `json:"tokens,omitempty"`
+	HMACKeys    []HMACCredential     `json:"hmac_keys,omitempty"`
+	ClientCerts []CertCredential     `json:"client_certs,omitempty"`
+	HMACMaxSkew core.Duration        `json:"hmac_max_skew,omitempty"` // default 5m
+}
+
+type AdminTLSConfig struct {
+	CertFile     string `json:"cert_file"`
+	KeyFile      string `json:"key_file"`
+	ClientCAFile string `json:"client_ca_file,omitempty"` // enables client certificates
+}
+
+// AdminRole is what a caller may do. Read covers the GET endpoints; Mutate
+// lists the route prefixes it may change, "*" for every route plus replacing
+// the whole config and rolling back.
+type AdminRole struct {
+	Read   bool     `json:"read"`
+	Mutate []string `json:"mutate,omitempty"`
+}
+
+type TokenCredential struct {
+	Name  string `json:"name"`
+	Token string `json:"token"`
+	Role  string `json:"role"`
+}
+
+type HMACCredential struct {
+	KeyID  string `json:"key_id"`
+	Secret string `json:"secret"`
+	Role   string `json:"role"`
+}
+
+// CertCredential maps a client certificate, by subject common name, to a role.
+type CertCredential struct {
+	Subject string `json:"subject"`
+	Role    string `json:"role"`
+}
+
+// LoadAdminConfig reads the admin config. Unknown fields are errors, so a
+// misspelt tls or client_ca_file setting cannot quietly weaken the listener.
+func LoadAdminConfig(path string) (*AdminConfig, error) {
+	var cfg AdminConfig
+	if err := core.DecodeConfigFile(path, &cfg); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// ServerTLS returns the TLS settings of the admin listener, nil for plain HTTP.
+func (cfg *AdminConfig) ServerTLS() (*tls.Config, error) {
+	if cfg.TLS == nil {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(cfg.TLS.CertFile, cfg.TLS.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	tc := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if cfg.TLS.ClientCAFile != "" {
+		pem, err := os.ReadFile(cfg.TLS.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", cfg.TLS.ClientCAFile)
+		}
+		tc.ClientCAs = pool
+		// Certificates are optional so that token and HMAC callers can use
+		// the same listener; one that is presented must verify.
+		tc.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return tc, nil
+}
+
+// Identity is an authenticated admin caller.
+type Identity struct {
+	Name   string
+	Method string // "token", "hmac", "mtls", or "none" when auth is disabled
+	Role   string
+	role   AdminRole
+}
+
+// CanRead reports whether id may call the read-only endpoints.
+func (id *Identity) CanRead() bool {
+	return id == nil || id.role.Read
+}
+
+// CanMutate reports whether id may change the route with prefix. An empty
+// prefix stands for changes to the whole config.
+func (id *Identity) CanMutate(prefix string) bool {
+	if id == nil {
+		return true
+	}
+	for _, allowed := range id.role.Mutate {
+		if allowed == "*" {
+			return true
+		}
+		if prefix != "" && prefixCovers(allowed, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// prefixCovers reports whether prefix lies under allowed, on path segment
+// boundaries: "/api" covers "/api" and "/api/v1" but not "/apix".
+func prefixCovers(allowed, prefix string) bool {
+	allowed = strings.TrimSuffix(allowed, "/")
+	return allowed == "" || prefix == allowed || strings.HasPrefix(prefix, allowed+"/")
+}
+
+// errNoCredentials is returned by an Authenticator when the request carries
+// no credentials of its kind, so the next one is tried.
+var errNoCredentials = errors.New("no credentials")
+
+// An Authenticator identifies the caller of an admin request.
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Identity, error)
+}
+
+// AdminAuth tries its authenticators in turn.
+type AdminAuth struct {
+	authenticators []Authenticator
+}
+
+// NewAdminAuth builds the authenticators configured in cfg. Every credential
+// must name a role defined in cfg.Roles.
+func NewAdminAuth(cfg *AdminConfig) (*AdminAuth, error) {
+	role := func(kind, name, role string) (AdminRole, error) {
+		r, ok := cfg.Roles[role]
+		if !ok {
+			return r, fmt.Errorf("%s %q: unknown role %q", kind, name, role)
+		}
+		return r, nil
+	}
+
+	auth := &AdminAuth{}
+	tokens := make(bearerTokens, 0, len(cfg.Tokens))
+	for _, t := range cfg.Tokens {
+		if t.Token == "" {
+			return nil, fmt.Errorf("token %q: token is empty", t.Name)
+		}
+		r, err := role("token", t.Name, t.Role)
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256([]byte(t.Token))
+		tokens = append(tokens, bearerToken{sum: sum, id: Identity{Name: t.Name, Method: "token", Role: t.Role, role: r}})
+	}
+	if len(tokens) > 0 {
+		auth.authenticators = append(auth.authenticators, tokens)
+	}
+
+	if len(cfg.HMACKeys) > 0 {
+		keys := &hmacKeys{keys: make(map[string]hmacKey), maxSkew: time.Duration(cfg.HMACMaxSkew), seen: make(map[string]time.Time)}
+		if keys.maxSkew <= 0 {
+			keys.maxSkew = defaultHMACMaxSkew
+		}
+		for _, k := range cfg.HMACKeys {
+			if k.Secret == "" {
+				return nil, fmt.Errorf("hmac key %q: secret is empty", k.KeyID)
+			}
+			r, err := role("hmac key", k.KeyID, k.Role)
+			if err != nil {
+				return nil, err
+			}
+			keys.keys[k.KeyID] = hmacKey{secret: []byte(k.Secret), id: Identity{Name: k.KeyID, Method: "hmac", Role: k.Role, role: r}}
+		}
+		auth.authenticators = append(auth.authenticators, keys)
+	}
+
+	if len(cfg.ClientCerts) > 0 {
+		if cfg.TLS == nil || cfg.TLS.ClientCAFile == "" {
+			return nil, errors.New("client_certs need tls.client_ca_file")
+		}
+		certs := make(clientCerts, len(cfg.ClientCerts))
+		for _, c := range cfg.ClientCerts {
+			r, err := role("client cert", c.Subject, c.Role)
+			if err != nil {
+				return nil, err
+			}
+			certs[c.Subject] = Identity{Name: c.Subject, Method: "mtls", Role: c.Role, role: r}
+		}
+		auth.authenticators = append(auth.authenticators, certs)
+	}
+
+	if len(auth.authenticators) == 0 {
+		return nil, errors.New("no tokens, hmac_keys or client_certs configured")
+	}
+	return auth, nil
+}
+
+func (a *AdminAuth) Authenticate(r *http.Request) (*Identity, error) {
+	for _, auth := range a.authenticators {
+		id, err := auth.Authenticate(r)
+		if errors.Is(err, errNoCredentials) {
+			continue
+		}
+		return id, err
+	}
+	return nil, errNoCredentials
+}
+
+type bearerToken struct {
+	sum [sha256.Size]byte
+	id  Identity
+}
+
+type bearerTokens []bearerToken
+
+func (t bearerTokens) Authenticate(r *http.Request) (*Identity, error) {
+	header := r.Header.Get("Authorization")
+	token, ok := strings.CutPrefix(header, "Bearer ")
+	if !ok {
+		return nil, errNoCredentials
+	}
+	// Comparing digests keeps the comparison constant time regardless of
+	// token length.
+	sum := sha256.Sum256([]byte(strings.TrimSpace(token)))
+	for i := range t {
+		if subtle.ConstantTimeCompare(sum[:], t[i].sum[:]) == 1 {
+			id := t[i].id
+			return &id, nil
+		}
+	}
+	return nil, errors.New("invalid bearer token")
+}
+
+type hmacKey struct {
+	secret []byte
+	id     Identity
+}
+
+type hmacKeys struct {
+	keys    map[string]hmacKey
+	maxSkew time.Duration
+
+	mu   sync.Mutex
+	seen map[string]time.Time // key id and nonce of accepted requests, until their timestamp expires
+}
+
+// Authenticate checks X-LB-Signature, the hex HMAC-SHA256 of
+// SignatureBase(method, request URI, X-LB-Timestamp, X-LB-Nonce, body) under
+// the secret of X-LB-Key. A nonce is accepted once while its timestamp is
+// within the skew, so a captured request cannot be replayed.
+func (h *hmacKeys) Authenticate(r *http.Request) (*Identity, error) {
+	keyID := r.Header.Get(HeaderHMACKey)
+	if keyID == "" {
+		return nil, errNoCredentials
+	}
+	key, ok := h.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("unknown hmac key %q", keyID)
+	}
+	timestamp := r.Header.Get(HeaderHMACTimestamp)
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return nil, errors.New("invalid " + HeaderHMACTimestamp)
+	}
+	if skew := time.Since(time.Unix(unix, 0)); skew > h.maxSkew || skew < -h.maxSkew {
+		return nil, errors.New(HeaderHMACTimestamp + " is too far from the current time")
+	}
+	nonce := r.Header.Get(HeaderHMACNonce)
+	if nonce == "" || len(nonce) > maxHMACNonceLength {
+		return nil, errors.New("missing or too long " + HeaderHMACNonce)
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	signature, err := hex.DecodeString(r.Header.Get(HeaderHMACSignature))
+	if err != nil {
+		return nil, errors.New("invalid " + HeaderHMACSignature)
+	}
+	mac := hmac.New(sha256.New, key.secret)
+	mac.Write([]byte(SignatureBase(r.Method, r.URL.RequestURI(), timestamp, nonce, body)))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return nil, errors.New("invalid hmac signature")
+	}
+	if !h.firstUse(keyID+"\n"+nonce, time.Unix(unix, 0).Add(h.maxSkew)) {
+		return nil, errors.New(HeaderHMACNonce + " was already used")
+	}
+	id := key.id
+	return &id, nil
+}
+
+// firstUse records a nonce until expires and reports whether it was new.
+// Expired nonces are dropped on the way; their timestamps are rejected anyway.
+func (h *hmacKeys) firstUse(nonce string, expires time.Time) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := time.Now()
+	maps.DeleteFunc(h.seen, func(_ string, until time.Time) bool {
+		return now.After(until)
+	})
+	if _, ok := h.seen[nonce]; ok {
+		return false
+	}
+	h.seen[nonce] = expires
+	return true
+}
+
+// SignatureBase is the string an HMAC-signed admin request signs: method,
+// request URI, unix timestamp, nonce and hex SHA-256 of the body, one per
+// line.
+func SignatureBase(method, requestURI, timestamp, nonce string, body []byte) string {
+	sum := sha256.Sum256(body)
+	return method + "\n" + requestURI + "\n" + timestamp + "\n" + nonce + "\n" + hex.EncodeToString(sum[:])
+}
+
+// clientCerts maps verified client certificate subjects to identities.
+type clientCerts map[string]Identity
+
+func (c clientCerts) Authenticate(r *http.Request) (*Identity, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return nil, errNoCredentials
+	}
+	subject := r.TLS.VerifiedChains[0][0].Subject.CommonName
+	id, ok := c[subject]
+	if !ok {
+		return nil, fmt.Errorf("client certificate %q is not allowed", subject)
+	}
+	return &id, nil
+}
+
+type identityKey struct{}
+
+// IdentityFrom returns the caller stored by AdminAuthMiddleware, nil if the
+// handler is not behind it.
+func IdentityFrom(ctx context.Context) *Identity {
+	id, _ := ctx.Value(identityKey{}).(*Identity)
+	return id
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	if s.status == 0 {
+		s.status = code
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+// Unwrap lets http.ResponseController reach the connection, e.g. to flush
+// event streams.
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	return s.ResponseWriter.Write(b)
+}
+
+// AdminAuthMiddleware authenticates admin requests and writes an audit log
+// entry for every call. With a nil auth every caller gets full access, which
+// is only meant for a listener bound to localhost.
+func AdminAuthMiddleware(auth *AdminAuth, next http.Handler) http.Handler {
+	anonymous := &Identity{Name: "anonymous", Method: "none", role: AdminRole{Read: true, Mutate: []string{"*"}}}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ctx := logger.WithRequestID(r.Context())
+		rec := &statusRecorder{ResponseWriter: w}
+		r.Body = http.MaxBytesReader(w, r.Body, maxAdminBodyBytes)
+
+		id, err := anonymous, error(nil)
+		if auth != nil {
+			id, err = auth.Authenticate(r)
+		}
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			logger.Error(ctx, "Admin request rejected", map[string]string{
+				"method": r.Method,
+				"path":   r.URL.RequestURI(),
+				"user":   r.RemoteAddr,
+				"status": strconv.Itoa(http.StatusRequestEntityTooLarge),
+				"error":  err.Error(),
+			})
+			http.Error(w, "Request Entity Too Large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil {
+			logger.Error(ctx, "Admin request rejected", map[string]string{
+				"method": r.Method,
+				"path":   r.URL.RequestURI(),
+				"user":   r.RemoteAddr,
+				"status": strconv.Itoa(http.StatusUnauthorized),
+				"error":  err.Error(),
+			})
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(rec, r.WithContext(context.WithValue(ctx, identityKey{}, id)))
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		logger.Info(ctx, "Admin request", map[string]string{
+			"method":   r.Method,
+			"path":     r.URL.RequestURI(),
+			"user":     id.Method + ":" + id.Name,
+			"status":   strconv.Itoa(rec.status),
+			"duration": time.Since(start).String(),
+		})
+	})
+}
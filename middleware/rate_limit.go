@@ -12,13 +12,16 @@ type RateLimiter struct {
 	tokens     map[string]int
 	lastRefill map[string]time.Time
 	mu         sync.Mutex
+
+	// Reject writes the response for a limited request; a plain-text 429 when nil.
+	Reject func(w http.ResponseWriter, r *http.Request)
 }
 
 func NewRateLimiter(rate, burst int) *RateLimiter {
 	return &RateLimiter{
-		rate:      rate,
-		burst:     burst,
-		tokens:    make(map[string]int),
+		rate:       rate,
+		burst:      burst,
+		tokens:     make(map[string]int),
 		lastRefill: make(map[string]time.Time),
 	}
 }
@@ -55,9 +58,13 @@ func RateLimitMiddleware(rl *RateLimiter, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		ip := r.RemoteAddr
 		if !rl.Allow(ip) {
+			if rl.Reject != nil {
+				rl.Reject(w, r)
+				return
+			}
 			http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
 			return
 		}
 		next.ServeHTTP(w, r)
 	})
-}
\ No newline at end of file
+}
@@ -1,63 +1,190 @@
 package core
 
 import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
 	"strings"
 )
 
-
+// TrieNode is one path segment. Besides literal children a node can have a
+// single-segment parameter child (":name", or "*" for an unnamed wildcard)
+// and a catch-all child ("**") that swallows the rest of the path.
 type TrieNode struct {
-	children map[string]*TrieNode
-	isEnd    bool
+	children  map[string]*TrieNode
+	param     *TrieNode
+	paramName string
+	catchAll  *TrieNode
+	isEnd     bool
+	pattern   string // route prefix as inserted, set when isEnd
+	depth     int
 }
 
 type Trie struct {
 	root *TrieNode
 }
 
-
 func NewTrie() *Trie {
 	return &Trie{
-		root: &TrieNode{children: make(map[string]*TrieNode)},
+		root: newTrieNode(0),
 	}
 }
 
+func newTrieNode(depth int) *TrieNode {
+	return &TrieNode{children: make(map[string]*TrieNode), depth: depth}
+}
 
-func (t *Trie) Insert(path string) {
+// Insert adds a route pattern. It fails when the pattern cannot coexist with
+// one already in the trie, e.g. "/users/:id" next to "/users/:name", or when
+// "**" is not the last segment.
+func (t *Trie) Insert(path string) error {
 	segments := splitPath(path)
 	node := t.root
 
-	for _, seg := range segments {
-		if _, ok := node.children[seg]; !ok {
-			node.children[seg] = &TrieNode{children: make(map[string]*TrieNode)}
+	for i, seg := range segments {
+		switch {
+		case seg == "**":
+			if i != len(segments)-1 {
+				return fmt.Errorf("route %s: ** must be the last segment", path)
+			}
+			if node.catchAll == nil {
+				node.catchAll = newTrieNode(i + 1)
+			}
+			node = node.catchAll
+
+		case seg == "*" || strings.HasPrefix(seg, ":"):
+			name := strings.TrimPrefix(seg, ":")
+			if name == "" {
+				return fmt.Errorf("route %s: empty parameter name", path)
+			}
+			if node.param == nil {
+				node.param = newTrieNode(i + 1)
+				node.paramName = name
+			} else if node.paramName != name {
+				return fmt.Errorf("route %s conflicts with existing pattern: segment %d is already bound as %s", path, i+1, displayParam(node.paramName))
+			}
+			node = node.param
+
+		default:
+			if _, ok := node.children[seg]; !ok {
+				node.children[seg] = newTrieNode(i + 1)
+			}
+			node = node.children[seg]
 		}
-		node = node.children[seg]
+	}
+	if node.isEnd && node.pattern != path {
+		return fmt.Errorf("route %s conflicts with existing route %s", path, node.pattern)
 	}
 	node.isEnd = true
+	node.pattern = path
+	return nil
 }
 
+// RouteMatch is the result of matching a request path against the trie.
+type RouteMatch struct {
+	Pattern string
+	Params  map[string]string
+	Route   string // route key, filled in by the load balancer
+}
 
-func (t *Trie) MatchPrefix(url string) (matched bool, matchedPath string) {
+// Match finds the deepest route pattern that is a prefix of url. When two
+// patterns match equally deep, literal segments beat parameters, and
+// parameters beat "**".
+func (t *Trie) Match(url string) (RouteMatch, bool) {
+	matches := t.MatchAll(url)
+	if len(matches) == 0 {
+		return RouteMatch{}, false
+	}
+	return matches[0], true
+}
+
+// MatchAll returns every route pattern that is a prefix of url, best match
+// first, so callers can fall back to shorter prefixes.
+func (t *Trie) MatchAll(url string) []RouteMatch {
 	segments := splitPath(url)
-	node := t.root
-	var pathParts []string
+	type found struct {
+		node  *TrieNode
+		match RouteMatch
+	}
+	var all []found
+	params := map[string]string{}
 
-	for _, seg := range segments {
-		next, ok := node.children[seg]
-		if !ok {
-			break
-		}
-		node = next
-		pathParts = append(pathParts, seg)
+	var walk func(node *TrieNode, i int)
+	walk = func(node *TrieNode, i int) {
 		if node.isEnd {
-			matched = true
-			matchedPath = "/" + strings.Join(pathParts, "/")
-			break;
+			all = append(all, found{node, RouteMatch{Pattern: node.pattern, Params: copyParams(params)}})
+		}
+		if i == len(segments) {
+			return
+		}
+		seg := segments[i]
+		if next, ok := node.children[seg]; ok {
+			walk(next, i+1)
+		}
+		if node.param != nil {
+			if node.paramName != "*" {
+				params[node.paramName] = seg
+			}
+			walk(node.param, i+1)
+			delete(params, node.paramName)
+		}
+		if node.catchAll != nil && node.catchAll.isEnd {
+			m := RouteMatch{Pattern: node.catchAll.pattern, Params: copyParams(params)}
+			m.Params["**"] = strings.Join(segments[i:], "/")
+			all = append(all, found{node.catchAll, m})
 		}
 	}
+	walk(t.root, 0)
 
-	return matched, matchedPath
+	// The walk visits literals before params before catch-alls, so a stable
+	// sort on depth keeps that priority among equally deep matches.
+	sort.SliceStable(all, func(i, j int) bool {
+		return all[i].node.depth > all[j].node.depth
+	})
+	out := make([]RouteMatch, len(all))
+	for i, f := range all {
+		out[i] = f.match
+	}
+	return out
 }
 
+// Overlapping lists existing routes with the same depth as path that can
+// match the same requests, which Match resolves by segment priority.
+func (t *Trie) Overlapping(path string) []string {
+	segments := splitPath(path)
+	var out []string
+
+	var walk func(node *TrieNode, i int)
+	walk = func(node *TrieNode, i int) {
+		if i == len(segments) {
+			if node.isEnd && node.pattern != path {
+				out = append(out, node.pattern)
+			}
+			return
+		}
+		seg := segments[i]
+		wild := seg == "*" || seg == "**" || strings.HasPrefix(seg, ":")
+		if node.catchAll != nil && i == len(segments)-1 && node.catchAll.isEnd && node.catchAll.pattern != path {
+			out = append(out, node.catchAll.pattern)
+		}
+		if seg == "**" {
+			return
+		}
+		if node.param != nil {
+			walk(node.param, i+1)
+		}
+		if wild {
+			for _, child := range node.children {
+				walk(child, i+1)
+			}
+		} else if next, ok := node.children[seg]; ok {
+			walk(next, i+1)
+		}
+	}
+	walk(t.root, 0)
+	return out
+}
 
 func splitPath(path string) []string {
 	path = strings.Trim(path, "/")
@@ -67,3 +194,73 @@ func splitPath(path string) []string {
 	return strings.Split(path, "/")
 }
 
+func copyParams(params map[string]string) map[string]string {
+	out := make(map[string]string, len(params))
+	for k, v := range params {
+		out[k] = v
+	}
+	return out
+}
+
+func displayParam(name string) string {
+	if name == "*" {
+		return "*"
+	}
+	return ":" + name
+}
+
+type routeMatchKey struct{}
+
+// WithRouteMatch stores the matched route and its captured parameters on the
+// request context.
+func WithRouteMatch(ctx context.Context, m RouteMatch) context.Context {
+	return context.WithValue(ctx, routeMatchKey{}, m)
+}
+
+// RouteMatchFromContext returns the route matched for the current request.
+func RouteMatchFromContext(ctx context.Context) (RouteMatch, bool) {
+	m, ok := ctx.Value(routeMatchKey{}).(RouteMatch)
+	return m, ok
+}
+
+// RouteParamHeader prefixes the headers that pass captured parameters to the
+// backend, e.g. X-Route-Param-Id for ":id".
+const RouteParamHeader = "X-Route-Param-"
+
+// forwardParams replaces whatever X-Route-Param-* headers the client sent
+// with the parameters of m, so backends can rely on them. The "**" capture
+// is left out; it is the rest of the path the backend already gets.
+func forwardParams(h http.Header, m RouteMatch) {
+	for k := range h {
+		if strings.HasPrefix(k, RouteParamHeader) {
+			delete(h, k)
+		}
+	}
+	for name, value := range m.Params {
+		if name != "**" {
+			h.Set(RouteParamHeader+name, value)
+		}
+	}
+}
+
+// String lists the captured parameters as name=value pairs in name order,
+// for the request log.
+func (m RouteMatch) String() string {
+	names := make([]string, 0, len(m.Params))
+	for name := range m.Params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = name + "=" + m.Params[name]
+	}
+	return strings.Join(pairs, " ")
+}
+
+// RouteParams returns the path parameters captured for the current request,
+// e.g. {"id": "42"} for "/users/:id".
+func RouteParams(ctx context.Context) map[string]string {
+	m, _ := RouteMatchFromContext(ctx)
+	return m.Params
+}
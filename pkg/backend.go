@@ -1,14 +1,15 @@
 package core
 
 import (
-	"hash/fnv"
-	"log"
+	"cmp"
+	"fmt"
 	"net/http/httputil"
 	"net/url"
+	"slices"
 	"strings"
 	"time"
 
-	// "sync"
+	"sync"
 	"sync/atomic"
 )
 
@@ -19,18 +20,72 @@ type Backend struct {
 	TotalRequests int64
 	TotalLatency  int64
 	Active        int64 //current number of active requests
+	Breaker       CircuitBreaker
+	Weight        int32 // relative share of traffic, at least 1
+	Latency       LatencyTracker
+
+	currentWeight int64                         // smooth weighted round robin state, atomic: pools sharing the backend pick concurrently
+	timeouts      atomic.Pointer[TimeoutConfig] // effective connect/response-header timeouts and per-attempt total
+	transport     TransportConfig               // settings the current transport was built with
+	roundTripper  *swappableTransport           // ReverseProxy.Transport
+	drain         atomic.Pointer[drainState]    // set while the backend is drained
+	warmingSince  int64                         // unix nanoseconds the slow-start ramp began, 0 once at full share
+	health        healthState
+	outlier       outlierState
 }
 
-func NewBackend(rawURL string) *Backend {
+// ParseBackendURL parses the URL of a backend, which must be an absolute
+// http or https URL.
+func ParseBackendURL(rawURL string) (*url.URL, error) {
 	parsedURL, err := url.Parse(rawURL)
 	if err != nil {
-		log.Fatalf("Invalid backend URL: %v", err)
+		return nil, fmt.Errorf("invalid backend URL: %w", err)
+	}
+	if parsedURL.Scheme != "http" && parsedURL.Scheme != "https" {
+		return nil, fmt.Errorf("invalid backend URL %q: scheme must be http or https", rawURL)
+	}
+	if parsedURL.Host == "" {
+		return nil, fmt.Errorf("invalid backend URL %q: host is missing", rawURL)
+	}
+	return parsedURL, nil
+}
+
+func NewBackend(rawURL string) (*Backend, error) {
+	parsedURL, err := ParseBackendURL(rawURL)
+	if err != nil {
+		return nil, err
 	}
-	return &Backend{
+	rt := &swappableTransport{}
+	rt.current.Store(newTransport(TimeoutConfig{}, nil))
+	proxy := httputil.NewSingleHostReverseProxy(parsedURL)
+	proxy.Transport = rt
+	proxy.ErrorHandler = proxyErrorHandler
+	b := &Backend{
 		URL:          parsedURL,
 		Alive:        1,
-		ReverseProxy: httputil.NewSingleHostReverseProxy(parsedURL),
+		ReverseProxy: proxy,
+		Weight:       1,
+		roundTripper: rt,
 	}
+	b.timeouts.Store(&TimeoutConfig{})
+	return b, nil
+}
+
+// Timeouts returns the effective connect/response-header timeouts and
+// per-attempt total of b.
+func (b *Backend) Timeouts() TimeoutConfig {
+	return *b.timeouts.Load()
+}
+
+func (b *Backend) SetWeight(weight int) {
+	if weight < 1 {
+		weight = 1
+	}
+	atomic.StoreInt32(&b.Weight, int32(weight))
+}
+
+func (b *Backend) GetWeight() int {
+	return int(atomic.LoadInt32(&b.Weight))
 }
 
 func (b *Backend) SetAlive(alive bool) {
@@ -52,92 +107,232 @@ const (
 	LeastLatency Strategy = "least_latency"
 	LeastActive  Strategy = "least_active"
 	IPHash       Strategy = "ip_hash"
+
+	WeightedRoundRobin Strategy = "weighted_round_robin"
+	ConsistentHash     Strategy = "consistent_hash"
+	PowerOfTwo         Strategy = "p2c"
 )
 
+// ParseStrategy returns the strategy named s, round robin if s is empty or
+// unknown. Use LookupStrategy to reject unknown names.
 func ParseStrategy(s string) Strategy {
+	strategy, _ := LookupStrategy(s)
+	return strategy
+}
 
+// LookupStrategy returns the strategy named s and whether s is a known name.
+// An empty name is round robin.
+func LookupStrategy(s string) (Strategy, bool) {
 	switch Strategy(strings.ToLower(s)) {
 	case LeastActive:
-		return LeastActive
+		return LeastActive, true
 	case LeastLatency:
-		return LeastLatency
+		return LeastLatency, true
 	case IPHash:
-		return IPHash
+		return IPHash, true
+	case WeightedRoundRobin:
+		return WeightedRoundRobin, true
+	case ConsistentHash:
+		return ConsistentHash, true
+	case PowerOfTwo:
+		return PowerOfTwo, true
+	case RoundRobin, "":
+		return RoundRobin, true
 	default:
-		return RoundRobin
+		return RoundRobin, false
 	}
 }
 
 type BackendPool struct {
-	Backends []*Backend
-	Current  int64
-	Strategy Strategy
+	Prefix         string
+	Match          *MatchRule
+	Backends       []*Backend
+	Current        int64
+	Strategy       Strategy
+	Retry          *RetryPolicy
+	CircuitBreaker *CircuitBreakerConfig
+	Outlier        *OutlierDetectionConfig
+	Split          *TrafficSplit // set when the route divides traffic between backend groups
+	Hash           *HashConfig
+	Sticky         *StickySessions
+	Latency        *LatencyConfig
+	SlowStart      *SlowStartConfig
+	HealthCheck    *HealthCheckConfig // nil to use the global health check settings
+	Timeouts       *TimeoutConfig
+	Transport      *TransportConfig
+	ErrorPages     *ErrorPages
+
+	mu           sync.Mutex // serializes weighted round robin picks and outlier ejections, guards ring
+	ring         *hashRing
+	config       RouteConfig // what the pool was built from, to detect changes on reload
+	outlierSweep int64       // unix nanoseconds of the last outlier detection sweep
 }
 
-func (BP *BackendPool) GetNextBackend(clientIP string) *Backend {
+// clone copies the pool for an admin change. Requests may still be using the
+// original, so it is replaced in the routing table rather than edited. The
+// backends are shared; the hash ring is rebuilt on first use.
+func (BP *BackendPool) clone() *BackendPool {
+	c := &BackendPool{
+		Prefix:         BP.Prefix,
+		Match:          BP.Match,
+		Backends:       slices.Clone(BP.Backends),
+		Current:        atomic.LoadInt64(&BP.Current),
+		Strategy:       BP.Strategy,
+		Retry:          BP.Retry,
+		CircuitBreaker: BP.CircuitBreaker,
+		Outlier:        BP.Outlier,
+		Hash:           BP.Hash,
+		Sticky:         BP.Sticky,
+		Latency:        BP.Latency,
+		SlowStart:      BP.SlowStart,
+		HealthCheck:    BP.HealthCheck,
+		Timeouts:       BP.Timeouts,
+		Transport:      BP.Transport,
+		ErrorPages:     BP.ErrorPages,
+		config:         BP.config,
+		outlierSweep:   atomic.LoadInt64(&BP.outlierSweep),
+	}
+	if BP.Split != nil {
+		c.Split = BP.Split.clone()
+		c.Split.inherit(c)
+	}
+	return c
+}
+
+// GetNextBackend picks a live backend according to the pool strategy. key
+// feeds the hashing strategies (the client IP unless the route's hash config
+// names another source). Backends listed in exclude (e.g. ones that already
+// failed this request) are skipped.
+//
+// On a route with slow start, a backend still ramping up gets only its
+// slow-start factor of its normal share: weighted round robin scales its
+// weight down, the other strategies pass it over with the remaining
+// probability. It is used anyway when nothing else is selectable.
+func (BP *BackendPool) GetNextBackend(key string, exclude ...*Backend) *Backend {
+	return BP.pick(key, exclude)
+}
+
+func (BP *BackendPool) pick(key string, exclude []*Backend) *Backend {
 	backends := BP.Backends
 	n := len(backends)
 	if n == 0 {
 		return nil
 	}
+	var held map[*Backend]bool
+	if BP.Strategy != WeightedRoundRobin {
+		held = BP.holdBack()
+	}
 
 	switch BP.Strategy {
 	case LeastActive:
-		var best *Backend
-		var minActive int64 = 1 << 60 // infinity
+		// Active requests per unit of weight; on a tie the heavier backend wins.
+		var best, fallback *Backend
+		var minActive float64 = 1e18 // infinity
 		for _, b := range backends {
-			if !b.IsAlive() {
+			if !BP.isSelectable(b, exclude) {
+				continue
+			}
+			if held[b] {
+				fallback = cmp.Or(fallback, b)
 				continue
 			}
-			active := b.ActiveRequests()
-			if active < minActive {
+			active := float64(b.ActiveRequests()) / float64(b.GetWeight())
+			if best == nil || active < minActive || (active == minActive && b.GetWeight() > best.GetWeight()) {
 				minActive = active
 				best = b
 			}
 		}
-		return best
+		return cmp.Or(best, fallback)
 
 	case LeastLatency:
-		var best *Backend
+		var best, fallback *Backend
 		var bestLatency float64 = 1e18
 		for _, b := range backends {
-			if !b.IsAlive() {
+			if !BP.isSelectable(b, exclude) {
 				continue
 			}
-			lat := b.AvgLatency()
-			if lat < bestLatency {
+			if held[b] {
+				fallback = cmp.Or(fallback, b)
+				continue
+			}
+			lat := b.Latency.Value(BP.Latency) / float64(b.GetWeight())
+			if best == nil || lat < bestLatency || (lat == bestLatency && b.GetWeight() > best.GetWeight()) {
 				bestLatency = lat
 				best = b
 			}
 		}
-		return best
-	case IPHash:
-		hash := hashIP(clientIP)
-		idx := int(hash) % n
-		for i := 0; i < n; i++ {
-			tryIdx := (idx + i) % n
-			b := backends[tryIdx]
-			if b.IsAlive() {
-				return b
+		return cmp.Or(best, fallback)
+
+	case WeightedRoundRobin:
+		// Smooth weighted round robin as in nginx: every pick raises each
+		// candidate by its weight and lowers the winner by the total, which
+		// spreads a 5:1:1 split as a a b a c a a rather than a a a a a b c.
+		BP.mu.Lock()
+		defer BP.mu.Unlock()
+		var best *Backend
+		var total, bestWeight int64
+		for _, b := range backends {
+			if !BP.isSelectable(b, exclude) {
+				continue
+			}
+			w := BP.wrrWeight(b)
+			current := atomic.AddInt64(&b.currentWeight, w)
+			total += w
+			if best == nil || current > bestWeight {
+				best, bestWeight = b, current
 			}
 		}
+		if best != nil {
+			atomic.AddInt64(&best.currentWeight, -total)
+		}
+		return best
+
+	case IPHash, ConsistentHash:
+		return BP.pickConsistent(key, exclude, held)
+	case PowerOfTwo:
+		return BP.pickP2C(exclude, held)
 	default: // Round robin (fallback)
+		var fallback *Backend
 		for range n {
 			next := atomic.AddInt64(&BP.Current, 1)
 			idx := int(next) % n
 			b := backends[idx]
-			if b.IsAlive() {
+			if !BP.isSelectable(b, exclude) {
+				continue
+			}
+			if !held[b] {
 				return b
 			}
+			fallback = cmp.Or(fallback, b)
 		}
+		return fallback
 	}
+}
 
-	return nil
+// HasSelectable reports whether GetNextBackend could return a backend
+// other than the ones in exclude.
+func (BP *BackendPool) HasSelectable(exclude ...*Backend) bool {
+	for _, b := range BP.Backends {
+		if BP.isSelectable(b, exclude) {
+			return true
+		}
+	}
+	return false
 }
-func hashIP(ip string) uint32 {
-    h := fnv.New32a()
-    h.Write([]byte(ip))
-    return h.Sum32()
+
+func (BP *BackendPool) isSelectable(b *Backend, exclude []*Backend) bool {
+	if !b.IsAlive() || b.IsDraining() || !b.Breaker.Ready(BP.CircuitBreaker) {
+		return false
+	}
+	if BP.Outlier != nil && b.outlier.ejected(time.Now()) {
+		return false
+	}
+	for _, e := range exclude {
+		if e == b {
+			return false
+		}
+	}
+	return true
 }
 
 func (p *BackendPool) SetBackendAlive(url *url.URL, alive bool) {
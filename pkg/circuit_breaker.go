@@ -0,0 +1,210 @@
+package core
+
+import (
+	"sync"
+	"time"
+)
+
+// CircuitState is the state of a backend's circuit breaker.
+type CircuitState int32
+
+const (
+	CircuitClosed CircuitState = iota
+	CircuitOpen
+	CircuitHalfOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half_open"
+	default:
+		return "closed"
+	}
+}
+
+// CircuitBreakerConfig is the per-route breaker policy. A backend trips when
+// either threshold is reached; a zero threshold disables that check.
+type CircuitBreakerConfig struct {
+	ConsecutiveFailures int      `json:"consecutive_failures,omitempty"`
+	ErrorRateThreshold  float64  `json:"error_rate_threshold,omitempty"` // 0.5 = 50% of requests in the window
+	MinRequests         int      `json:"min_requests,omitempty"`         // requests needed in the window before the rate is trusted
+	Window              Duration `json:"window,omitempty"`
+	OpenDuration        Duration `json:"open_duration,omitempty"`
+	HalfOpenRequests    int      `json:"half_open_requests,omitempty"` // successful probes needed to close again
+}
+
+func (c *CircuitBreakerConfig) window() time.Duration {
+	if c.Window > 0 {
+		return time.Duration(c.Window)
+	}
+	return 10 * time.Second
+}
+
+func (c *CircuitBreakerConfig) openDuration() time.Duration {
+	if c.OpenDuration > 0 {
+		return time.Duration(c.OpenDuration)
+	}
+	return 30 * time.Second
+}
+
+func (c *CircuitBreakerConfig) minRequests() int {
+	if c.MinRequests > 0 {
+		return c.MinRequests
+	}
+	return 10
+}
+
+func (c *CircuitBreakerConfig) halfOpenRequests() int {
+	if c.HalfOpenRequests > 0 {
+		return c.HalfOpenRequests
+	}
+	return 1
+}
+
+// CircuitBreaker holds the passive failure state of one backend. The policy
+// lives on the pool, so every method takes the config; a nil config means the
+// route has no breaker and the backend is always allowed.
+type CircuitBreaker struct {
+	mu          sync.Mutex
+	state       CircuitState
+	consecutive int
+	windowStart time.Time
+	windowReqs  int
+	windowFails int
+	openedAt    time.Time
+	probes      int // half-open requests in flight
+	successes   int // successful half-open requests
+}
+
+// Ready reports whether the backend may be selected. It has no side effects,
+// so strategies can call it while scanning the pool.
+func (cb *CircuitBreaker) Ready(cfg *CircuitBreakerConfig) bool {
+	if cfg == nil {
+		return true
+	}
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	switch cb.state {
+	case CircuitOpen:
+		return time.Since(cb.openedAt) >= cfg.openDuration()
+	case CircuitHalfOpen:
+		return cb.probes < cfg.halfOpenRequests()
+	default:
+		return true
+	}
+}
+
+// Begin is called once a backend has been chosen for a request. An expired
+// open circuit moves to half-open and the request becomes a probe.
+func (cb *CircuitBreaker) Begin(cfg *CircuitBreakerConfig) (changed bool, state CircuitState) {
+	if cfg == nil {
+		return false, CircuitClosed
+	}
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if cb.state == CircuitOpen && time.Since(cb.openedAt) >= cfg.openDuration() {
+		cb.state = CircuitHalfOpen
+		cb.probes = 0
+		cb.successes = 0
+		changed = true
+	}
+	if cb.state == CircuitHalfOpen {
+		cb.probes++
+	}
+	return changed, cb.state
+}
+
+// Record feeds the outcome of a proxied request into the breaker.
+func (cb *CircuitBreaker) Record(cfg *CircuitBreakerConfig, failed bool) (changed bool, state CircuitState) {
+	if cfg == nil {
+		return false, CircuitClosed
+	}
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	now := time.Now()
+
+	switch cb.state {
+	case CircuitHalfOpen:
+		if cb.probes > 0 {
+			cb.probes--
+		}
+		if failed {
+			cb.trip(now)
+			return true, cb.state
+		}
+		cb.successes++
+		if cb.successes >= cfg.halfOpenRequests() {
+			cb.reset(now)
+			return true, cb.state
+		}
+		return false, cb.state
+
+	case CircuitOpen:
+		// A request that was in flight when the circuit tripped.
+		return false, cb.state
+	}
+
+	if now.Sub(cb.windowStart) > cfg.window() {
+		cb.windowStart = now
+		cb.windowReqs = 0
+		cb.windowFails = 0
+	}
+	cb.windowReqs++
+	if failed {
+		cb.windowFails++
+		cb.consecutive++
+	} else {
+		cb.consecutive = 0
+	}
+
+	if cfg.ConsecutiveFailures > 0 && cb.consecutive >= cfg.ConsecutiveFailures {
+		cb.trip(now)
+		return true, cb.state
+	}
+	if cfg.ErrorRateThreshold > 0 && cb.windowReqs >= cfg.minRequests() &&
+		float64(cb.windowFails)/float64(cb.windowReqs) >= cfg.ErrorRateThreshold {
+		cb.trip(now)
+		return true, cb.state
+	}
+	return false, cb.state
+}
+
+// Cancel ends a request that has no outcome, such as one the client
+// abandoned, freeing its half-open probe slot.
+func (cb *CircuitBreaker) Cancel(cfg *CircuitBreakerConfig) {
+	if cfg == nil {
+		return
+	}
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if cb.state == CircuitHalfOpen && cb.probes > 0 {
+		cb.probes--
+	}
+}
+
+// State returns the current state without advancing it.
+func (cb *CircuitBreaker) State() CircuitState {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	return cb.state
+}
+
+func (cb *CircuitBreaker) trip(now time.Time) {
+	cb.state = CircuitOpen
+	cb.openedAt = now
+	cb.probes = 0
+	cb.successes = 0
+}
+
+func (cb *CircuitBreaker) reset(now time.Time) {
+	cb.state = CircuitClosed
+	cb.consecutive = 0
+	cb.windowStart = now
+	cb.windowReqs = 0
+	cb.windowFails = 0
+	cb.probes = 0
+	cb.successes = 0
+}
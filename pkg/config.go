@@ -0,0 +1,97 @@
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+type RouteConfig struct {
+	Name     string          `json:"name,omitempty"` // required when Match is set
+	Prefix   string          `json:"prefix"`
+	Match    *MatchConfig    `json:"match,omitempty"`
+	Backends []BackendConfig `json:"backends,omitempty"`
+	Strategy string          `json:"strategy,omitempty"`
+	Retry    *RetryPolicy    `json:"retry,omitempty"`
+	Hash     *HashConfig     `json:"hash,omitempty"`
+	Sticky   *StickyConfig   `json:"sticky,omitempty"`
+	Latency  *LatencyConfig  `json:"latency,omitempty"`
+	Timeouts *TimeoutConfig  `json:"timeouts,omitempty"`
+
+	Transport *TransportConfig `json:"transport,omitempty"`
+
+	CircuitBreaker *CircuitBreakerConfig   `json:"circuit_breaker,omitempty"`
+	Outlier        *OutlierDetectionConfig `json:"outlier_detection,omitempty"`
+	SlowStart      *SlowStartConfig        `json:"slow_start,omitempty"`
+	HealthCheck    *HealthCheckConfig      `json:"health_check,omitempty"`  // fields left out come from the health settings
+	TrafficSplit   *TrafficSplitConfig     `json:"traffic_split,omitempty"` // replaces Backends
+	ErrorPages     *ErrorPagesConfig       `json:"error_pages,omitempty"`
+}
+
+// BackendConfig is one backend of a route. In JSON it is either a plain URL
+// string or an object with a url, a weight and timeouts.
+type BackendConfig struct {
+	URL      string         `json:"url"`
+	Weight   int            `json:"weight,omitempty"`
+	Timeouts *TimeoutConfig `json:"timeouts,omitempty"`
+}
+
+func (b *BackendConfig) UnmarshalJSON(data []byte) error {
+	var url string
+	if err := json.Unmarshal(data, &url); err == nil {
+		*b = BackendConfig{URL: url}
+		return nil
+	}
+	type plain BackendConfig
+	return json.Unmarshal(data, (*plain)(b))
+}
+
+func (b BackendConfig) MarshalJSON() ([]byte, error) {
+	if b.Weight <= 1 && b.Timeouts == nil {
+		return json.Marshal(b.URL)
+	}
+	type plain BackendConfig
+	return json.Marshal(plain(b))
+}
+
+// BackendURLs builds unweighted backend configs from plain URLs.
+func BackendURLs(urls ...string) []BackendConfig {
+	out := make([]BackendConfig, 0, len(urls))
+	for _, u := range urls {
+		out = append(out, BackendConfig{URL: u})
+	}
+	return out
+}
+
+// Key identifies the route in LoadBalancer.Routes, the admin API and metric
+// labels: its name if it has one, otherwise its prefix.
+func (r RouteConfig) Key() string {
+	if r.Name != "" {
+		return r.Name
+	}
+	return r.Prefix
+}
+
+type Config struct {
+	Version    int64             `json:"version,omitempty"` // bumped on every persisted admin change
+	Routes     []RouteConfig     `json:"routes"`
+	ErrorPages *ErrorPagesConfig `json:"error_pages,omitempty"`
+}
+
+// LoadConfig reads a JSON, YAML or TOML config, chosen by the extension of
+// path, and validates it. Unknown fields are rejected.
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := ParseConfig(data, configFormat(path))
+	var cfgErr *ConfigError
+	if errors.As(err, &cfgErr) {
+		cfgErr.File = path
+	} else if err != nil {
+		err = fmt.Errorf("%s: %w", path, err)
+	}
+	return cfg, err
+}
@@ -0,0 +1,190 @@
+package core
+
+import (
+	"hash/fnv"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const defaultVirtualNodes = 100
+
+// HashConfig tunes the ip_hash and consistent_hash strategies.
+type HashConfig struct {
+	Key          string  `json:"key,omitempty"`           // "ip" (default), "header:<name>", "cookie:<name>", "param:<name>" or "query:<name>"
+	VirtualNodes int     `json:"virtual_nodes,omitempty"` // ring points per unit of backend weight
+	LoadFactor   float64 `json:"load_factor,omitempty"`   // bounded load: max active per backend as a multiple of the average, 0 = unbounded
+}
+
+func (c *HashConfig) virtualNodes() int {
+	if c != nil && c.VirtualNodes > 0 {
+		return c.VirtualNodes
+	}
+	return defaultVirtualNodes
+}
+
+func (c *HashConfig) key() string {
+	if c == nil {
+		return ""
+	}
+	return c.Key
+}
+
+// requestKey extracts the value named by spec from the request. It falls back
+// to the client IP when the spec is empty or the value is missing.
+func requestKey(spec string, req *http.Request, clientIP string) string {
+	kind, name, _ := strings.Cut(spec, ":")
+	switch kind {
+	case "header":
+		if v := req.Header.Get(name); v != "" {
+			return v
+		}
+	case "cookie":
+		if cookie, err := req.Cookie(name); err == nil && cookie.Value != "" {
+			return cookie.Value
+		}
+	case "param":
+		if v := RouteParams(req.Context())[name]; v != "" {
+			return v
+		}
+	case "query":
+		if v := req.URL.Query().Get(name); v != "" {
+			return v
+		}
+	}
+	return clientIP
+}
+
+// hashRing places every backend on a ring of 64-bit points, weight times
+// VirtualNodes each. A key maps to the first point clockwise from its hash,
+// so adding or removing a backend only moves the keys next to its points.
+type hashRing struct {
+	points  []uint64
+	owners  []*Backend // owners[i] owns points[i]
+	members []*Backend // pool membership the ring was built from
+	weights []int
+	vnodes  int
+}
+
+func newHashRing(backends []*Backend, vnodes int) *hashRing {
+	r := &hashRing{vnodes: vnodes}
+	type point struct {
+		hash  uint64
+		owner *Backend
+	}
+	var pts []point
+	for _, b := range backends {
+		w := b.GetWeight()
+		r.members = append(r.members, b)
+		r.weights = append(r.weights, w)
+		id := b.URL.String()
+		for i := 0; i < w*vnodes; i++ {
+			pts = append(pts, point{hashKey(id + "#" + strconv.Itoa(i)), b})
+		}
+	}
+	sort.Slice(pts, func(i, j int) bool { return pts[i].hash < pts[j].hash })
+	r.points = make([]uint64, len(pts))
+	r.owners = make([]*Backend, len(pts))
+	for i, p := range pts {
+		r.points[i] = p.hash
+		r.owners[i] = p.owner
+	}
+	return r
+}
+
+// matches reports whether the ring still reflects the pool's backends.
+func (r *hashRing) matches(backends []*Backend, vnodes int) bool {
+	if r == nil || r.vnodes != vnodes || len(r.members) != len(backends) {
+		return false
+	}
+	for i, b := range backends {
+		if r.members[i] != b || r.weights[i] != b.GetWeight() {
+			return false
+		}
+	}
+	return true
+}
+
+// hashRing returns the pool's ring, rebuilding it after membership or
+// weight changes. Callers must hold BP.mu.
+func (BP *BackendPool) hashRing() *hashRing {
+	vnodes := BP.Hash.virtualNodes()
+	if !BP.ring.matches(BP.Backends, vnodes) {
+		BP.ring = newHashRing(BP.Backends, vnodes)
+	}
+	return BP.ring
+}
+
+// pickConsistent walks the ring clockwise from the key's hash and returns the
+// first selectable backend. With a load factor, backends already carrying
+// more than factor × the average active requests are passed over, and so are
+// held backends; the first of either is used when nothing else is left.
+func (BP *BackendPool) pickConsistent(key string, exclude []*Backend, held map[*Backend]bool) *Backend {
+	BP.mu.Lock()
+	ring := BP.hashRing()
+	BP.mu.Unlock()
+	if len(ring.points) == 0 {
+		return nil
+	}
+
+	limit := int64(math.MaxInt64)
+	if factor := BP.loadFactor(); factor > 0 {
+		var total int64
+		n := 0
+		for _, b := range ring.members {
+			if BP.isSelectable(b, exclude) {
+				total += b.ActiveRequests()
+				n++
+			}
+		}
+		if n == 0 {
+			return nil
+		}
+		limit = int64(math.Ceil(factor * float64(total+1) / float64(n)))
+	}
+
+	h := hashKey(key)
+	start := sort.Search(len(ring.points), func(i int) bool { return ring.points[i] >= h })
+	var fallback *Backend
+	seen := make(map[*Backend]bool, len(ring.members))
+	for i := 0; i < len(ring.points) && len(seen) < len(ring.members); i++ {
+		b := ring.owners[(start+i)%len(ring.points)]
+		if seen[b] {
+			continue
+		}
+		seen[b] = true
+		if !BP.isSelectable(b, exclude) {
+			continue
+		}
+		if !held[b] && b.ActiveRequests() < limit {
+			return b
+		}
+		if fallback == nil {
+			fallback = b
+		}
+	}
+	return fallback
+}
+
+func (BP *BackendPool) loadFactor() float64 {
+	if BP.Hash == nil || BP.Hash.LoadFactor <= 0 {
+		return 0
+	}
+	return math.Max(BP.Hash.LoadFactor, 1)
+}
+
+// hashKey is FNV-1a followed by a 64-bit finalizer, since FNV alone spreads
+// similar strings such as "url#1", "url#2" poorly around the ring.
+func hashKey(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
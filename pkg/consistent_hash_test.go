@@ -0,0 +1,144 @@
+package core
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"testing"
+)
+
+const ringTestKeys = 10000
+
+func newHashPool(t *testing.T, n int, hash *HashConfig) *BackendPool {
+	t.Helper()
+	urls := make([]string, n)
+	for i := range urls {
+		urls[i] = fmt.Sprintf("http://backend-%d:8080", i)
+	}
+	pool, err := NewRoute(BackendURLs(urls...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool.Strategy = ConsistentHash
+	pool.Hash = hash
+	return pool
+}
+
+func assignKeys(t *testing.T, pool *BackendPool) map[string]*Backend {
+	t.Helper()
+	owners := make(map[string]*Backend, ringTestKeys)
+	for i := 0; i < ringTestKeys; i++ {
+		key := "client-" + strconv.Itoa(i)
+		b := pool.GetNextBackend(key)
+		if b == nil {
+			t.Fatalf("no backend for %s", key)
+		}
+		owners[key] = b
+	}
+	return owners
+}
+
+// checkShare fails unless moved keys are within half of the expected share.
+func checkShare(t *testing.T, moved int, share float64) {
+	t.Helper()
+	got := float64(moved) / ringTestKeys
+	if got < share/2 || got > share*1.5 {
+		t.Errorf("%d of %d keys moved (%.3f), want about %.3f", moved, ringTestKeys, got, share)
+	}
+}
+
+func TestConsistentHashRemoveBackend(t *testing.T) {
+	for _, n := range []int{3, 5, 10} {
+		t.Run(strconv.Itoa(n), func(t *testing.T) {
+			pool := newHashPool(t, n, nil)
+			before := assignKeys(t, pool)
+
+			removed := pool.Backends[n/2]
+			pool.Backends = append(pool.Backends[:n/2:n/2], pool.Backends[n/2+1:]...)
+			after := assignKeys(t, pool)
+
+			moved := 0
+			for key, owner := range before {
+				if after[key] == owner {
+					continue
+				}
+				if owner != removed {
+					t.Fatalf("key %s moved from %s, which is still in the pool", key, owner.URL)
+				}
+				moved++
+			}
+			checkShare(t, moved, 1/float64(n))
+		})
+	}
+}
+
+func TestConsistentHashAddBackend(t *testing.T) {
+	for _, n := range []int{3, 5, 10} {
+		t.Run(strconv.Itoa(n), func(t *testing.T) {
+			pool := newHashPool(t, n, nil)
+			before := assignKeys(t, pool)
+
+			added, err := NewBackend("http://backend-new:8080")
+			if err != nil {
+				t.Fatal(err)
+			}
+			pool.Backends = append(pool.Backends, added)
+			after := assignKeys(t, pool)
+
+			moved := 0
+			for key, owner := range before {
+				if after[key] == owner {
+					continue
+				}
+				if after[key] != added {
+					t.Fatalf("key %s moved to %s, not the new backend", key, after[key].URL)
+				}
+				moved++
+			}
+			checkShare(t, moved, 1/float64(n+1))
+		})
+	}
+}
+
+func TestConsistentHashBoundedLoad(t *testing.T) {
+	tests := []struct {
+		backends int
+		factor   float64
+	}{
+		{3, 1},
+		{3, 1.25},
+		{5, 1.25},
+		{10, 1.5},
+		{10, 2},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%d backends, c=%g", tt.backends, tt.factor), func(t *testing.T) {
+			pool := newHashPool(t, tt.backends, &HashConfig{LoadFactor: tt.factor})
+			// Every key holds its request open, so the load only grows.
+			for i := 1; i <= ringTestKeys; i++ {
+				b := pool.GetNextBackend("client-" + strconv.Itoa(i))
+				if b == nil {
+					t.Fatalf("no backend for key %d", i)
+				}
+				b.IncActive()
+
+				limit := int64(math.Ceil(tt.factor * float64(i) / float64(tt.backends)))
+				for _, b := range pool.Backends {
+					if active := b.ActiveRequests(); active > limit {
+						t.Fatalf("after %d keys %s has %d active, more than ceil(c·avg) = %d", i, b.URL, active, limit)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestConsistentHashStableWithoutChanges(t *testing.T) {
+	pool := newHashPool(t, 5, nil)
+	first, second := assignKeys(t, pool), assignKeys(t, pool)
+	for key, owner := range first {
+		if second[key] != owner {
+			t.Fatalf("key %s moved from %s to %s without a pool change", key, owner.URL, second[key].URL)
+		}
+	}
+}
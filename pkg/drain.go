@@ -0,0 +1,151 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/shashankk204/load_balancer/pkg/logger"
+)
+
+// DrainOptions say what happens to a drained backend.
+type DrainOptions struct {
+	Remove  bool     `json:"remove,omitempty"`  // remove the backend from the route once it is idle
+	Timeout Duration `json:"timeout,omitempty"` // with Remove, remove it after this long even if requests are still in flight
+}
+
+type drainState struct {
+	DrainOptions
+	Started time.Time `json:"started"`
+	cancel  context.CancelFunc
+}
+
+// IsDraining reports whether the backend is being drained.
+func (b *Backend) IsDraining() bool {
+	return b.drain.Load() != nil
+}
+
+// DrainBackend stops sending new requests of a route to a backend while the
+// ones in flight finish. Sticky clients pinned to it are re-pinned. author is
+// recorded in the config history if the backend is removed.
+func (lb *LoadBalancer) DrainBackend(prefix, backendURL string, opts DrainOptions, author string) error {
+	if opts.Timeout < 0 {
+		return fmt.Errorf("timeout must not be negative")
+	}
+	if opts.Timeout > 0 && !opts.Remove {
+		return fmt.Errorf("timeout only applies when the backend is removed")
+	}
+	b, err := lb.findBackend(prefix, backendURL)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	state := &drainState{DrainOptions: opts, Started: time.Now().UTC(), cancel: cancel}
+	if old := b.drain.Swap(state); old != nil {
+		old.cancel()
+	}
+	go lb.runDrain(ctx, prefix, b, state, author)
+	return nil
+}
+
+// UndrainBackend puts a drained backend back into rotation.
+func (lb *LoadBalancer) UndrainBackend(prefix, backendURL string) error {
+	b, err := lb.findBackend(prefix, backendURL)
+	if err != nil {
+		return err
+	}
+	state := b.drain.Swap(nil)
+	if state == nil {
+		return fmt.Errorf("backend %s is not draining", backendURL)
+	}
+	state.cancel()
+	logger.Info(logger.WithRequestID(context.Background()), "Backend drain cancelled", map[string]string{
+		"route":   prefix,
+		"backend": backendURL,
+	})
+	return nil
+}
+
+func (lb *LoadBalancer) findBackend(prefix, backendURL string) (*Backend, error) {
+	lb.mux.RLock()
+	defer lb.mux.RUnlock()
+	pool, ok := lb.Routes[prefix]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrRouteNotFound, prefix)
+	}
+	for _, b := range pool.Backends {
+		if b.URL.String() == backendURL {
+			return b, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s on route %s", ErrBackendNotFound, backendURL, prefix)
+}
+
+// runDrain waits for the backend to go idle and removes it if asked to.
+func (lb *LoadBalancer) runDrain(ctx context.Context, prefix string, b *Backend, state *drainState, author string) {
+	logCtx := logger.WithRequestID(context.Background())
+	url := b.URL.String()
+	logger.Info(logCtx, "Backend draining", map[string]string{
+		"route":   prefix,
+		"backend": url,
+	})
+
+	var deadline <-chan time.Time
+	if state.Timeout > 0 {
+		timer := time.NewTimer(time.Duration(state.Timeout))
+		defer timer.Stop()
+		deadline = timer.C
+	}
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for b.ActiveRequests() > 0 {
+		select {
+		case <-ctx.Done():
+			return
+		case <-deadline:
+			logger.Error(logCtx, "Backend drain timed out", map[string]string{
+				"route":   prefix,
+				"backend": url,
+				"error":   fmt.Sprintf("%d requests still in flight after %s", b.ActiveRequests(), time.Duration(state.Timeout)),
+			})
+			lb.removeDrained(logCtx, prefix, b, author)
+			return
+		case <-ticker.C:
+		}
+	}
+
+	fields := map[string]string{
+		"route":    prefix,
+		"backend":  url,
+		"duration": time.Since(state.Started).String(),
+	}
+	logger.Info(logCtx, "Backend drained", fields)
+	if state.Remove {
+		lb.removeDrained(logCtx, prefix, b, author)
+	}
+}
+
+// errBackendGone skips the removal of a drained backend that is gone already.
+var errBackendGone = errors.New("backend is gone")
+
+// removeDrained removes b from the route unless it is already gone, e.g.
+// because the route was reloaded meanwhile.
+func (lb *LoadBalancer) removeDrained(ctx context.Context, prefix string, b *Backend, author string) {
+	url := b.URL.String()
+	_, err := lb.Change(author, "remove-backend "+url+" after drain", func() error {
+		if current, err := lb.findBackend(prefix, url); err != nil || current != b {
+			return errBackendGone
+		}
+		return lb.RemoveBackendFromRoute(prefix, url)
+	})
+	var persistErr *PersistError
+	if errors.As(err, &persistErr) {
+		logger.Error(ctx, "Failed to persist drained backend removal", map[string]string{
+			"route":   prefix,
+			"backend": url,
+			"error":   err.Error(),
+		})
+	}
+}
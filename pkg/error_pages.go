@@ -0,0 +1,196 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"net/http"
+	"strconv"
+	"text/template"
+
+	"github.com/shashankk204/load_balancer/pkg/logger"
+)
+
+const (
+	ErrorFormatJSON = "json"
+	ErrorFormatHTML = "html"
+	ErrorFormatText = "text"
+)
+
+// ErrorPagesConfig customizes the responses the load balancer generates
+// itself (404, 429, 500, 502, 503, 504). It can be set globally and per route;
+// a route falls back to the global pages for status codes it does not cover.
+type ErrorPagesConfig struct {
+	Format    string            `json:"format,omitempty"`    // "json" (default), "html" or "text"
+	Templates map[string]string `json:"templates,omitempty"` // status code or "default" -> Go template for the body
+}
+
+// ErrorPageData is what error page templates are executed with.
+type ErrorPageData struct {
+	Status     int    `json:"status"`
+	StatusText string `json:"error"`
+	Message    string `json:"message"`
+	RequestID  string `json:"request_id,omitempty"`
+	Route      string `json:"route,omitempty"`
+	Method     string `json:"-"`
+	Path       string `json:"-"`
+}
+
+type pageTemplate interface {
+	Execute(io.Writer, any) error
+}
+
+// ErrorPages is a compiled ErrorPagesConfig.
+type ErrorPages struct {
+	Config    *ErrorPagesConfig
+	templates map[int]pageTemplate // 0 holds the "default" template
+}
+
+func NewErrorPages(cfg *ErrorPagesConfig) (*ErrorPages, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	switch cfg.Format {
+	case "", ErrorFormatJSON, ErrorFormatHTML, ErrorFormatText:
+	default:
+		return nil, fmt.Errorf("unknown error page format %q", cfg.Format)
+	}
+	p := &ErrorPages{Config: cfg, templates: make(map[int]pageTemplate)}
+	for key, text := range cfg.Templates {
+		code := 0
+		if key != "default" {
+			var err error
+			if code, err = strconv.Atoi(key); err != nil || code < 400 || code > 599 {
+				return nil, fmt.Errorf("error page key %q is neither a 4xx/5xx status code nor \"default\"", key)
+			}
+		}
+		var tmpl pageTemplate
+		var err error
+		if cfg.Format == ErrorFormatHTML {
+			tmpl, err = htmltemplate.New(key).Parse(text)
+		} else {
+			tmpl, err = template.New(key).Parse(text)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error page %s: %w", key, err)
+		}
+		p.templates[code] = tmpl
+	}
+	return p, nil
+}
+
+func (p *ErrorPages) template(status int) pageTemplate {
+	if t, ok := p.templates[status]; ok {
+		return t
+	}
+	return p.templates[0]
+}
+
+// errorMessage is the message shown for errors the load balancer generates.
+func errorMessage(status int) string {
+	switch status {
+	case http.StatusBadGateway:
+		return "The backend could not be reached"
+	case http.StatusGatewayTimeout:
+		return "The backend did not respond in time"
+	case http.StatusInternalServerError:
+		return "Internal error in the load balancer"
+	default:
+		return http.StatusText(status)
+	}
+}
+
+var defaultHTMLErrorPage = htmltemplate.Must(htmltemplate.New("default").Parse(`<!DOCTYPE html>
+<html>
+<head><title>{{.Status}} {{.StatusText}}</title></head>
+<body>
+<h1>{{.Status}} {{.StatusText}}</h1>
+<p>{{.Message}}</p>
+{{if .RequestID}}<p><small>Request ID: {{.RequestID}}</small></p>{{end}}
+</body>
+</html>
+`))
+
+// writeErrorPage writes a generated error response. The first of pages with
+// a template for status (or a default template) renders the body; otherwise
+// the built-in body is used in the first format configured.
+func writeErrorPage(ctx context.Context, w http.ResponseWriter, req *http.Request, route string, status int, message string, pages ...*ErrorPages) {
+	data := ErrorPageData{
+		Status:     status,
+		StatusText: http.StatusText(status),
+		Message:    message,
+		RequestID:  logger.GetRequestID(ctx),
+		Route:      route,
+		Method:     req.Method,
+		Path:       req.URL.Path,
+	}
+
+	format := ""
+	var tmpl pageTemplate
+	for _, p := range pages {
+		if p == nil {
+			continue
+		}
+		if t := p.template(status); t != nil {
+			format, tmpl = p.Config.Format, t
+			break
+		}
+		if format == "" {
+			format = p.Config.Format
+		}
+	}
+
+	var body bytes.Buffer
+	if tmpl != nil {
+		if err := tmpl.Execute(&body, data); err != nil {
+			logger.Error(ctx, "Failed to render error page", map[string]string{
+				"path":   req.URL.Path,
+				"status": strconv.Itoa(status),
+				"error":  err.Error(),
+			})
+			tmpl = nil
+			body.Reset()
+		}
+	}
+	if tmpl == nil {
+		switch format {
+		case ErrorFormatHTML:
+			defaultHTMLErrorPage.Execute(&body, data)
+		case ErrorFormatText:
+			body.WriteString(message + "\n")
+		default:
+			json.NewEncoder(&body).Encode(data)
+		}
+	}
+
+	switch format {
+	case ErrorFormatHTML:
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	case ErrorFormatText:
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	default:
+		w.Header().Set("Content-Type", "application/json")
+	}
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Del("Content-Length")
+	w.WriteHeader(status)
+	w.Write(body.Bytes())
+}
+
+// WriteError writes an error response for req using the pages of the route
+// it would be sent to. It is meant for handlers in front of the load
+// balancer, such as the rate limiter.
+func (lb *LoadBalancer) WriteError(w http.ResponseWriter, req *http.Request, status int, message string) {
+	lb.mux.RLock()
+	global := lb.ErrorPages
+	route, _, ok := lb.findRoute(req)
+	var pages *ErrorPages
+	if ok {
+		pages = lb.Routes[route].ErrorPages
+	}
+	lb.mux.RUnlock()
+	writeErrorPage(req.Context(), w, req, route, status, message, pages, global)
+}
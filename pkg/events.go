@@ -0,0 +1,154 @@
+package core
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/shashankk204/load_balancer/pkg/logger"
+)
+
+const (
+	defaultHealthEventLimit = 500 // transitions kept in memory
+	healthEventBuffer       = 64  // events a subscriber may fall behind before missing some
+)
+
+// HealthEvent is a transition of a backend between UP and DOWN.
+type HealthEvent struct {
+	ID      int64     `json:"id"`
+	Time    time.Time `json:"time"`
+	Route   string    `json:"route"`
+	Backend string    `json:"backend"`
+	State   string    `json:"state"` // UP or DOWN
+	Reason  string    `json:"reason,omitempty"`
+}
+
+// HealthEvents keeps the most recent transitions and passes new ones on to
+// subscribers, such as admin API event streams.
+type HealthEvents struct {
+	mu     sync.Mutex
+	ring   []HealthEvent // oldest first
+	limit  int
+	lastID int64
+	subs   map[chan HealthEvent]struct{}
+	closed bool
+}
+
+func NewHealthEvents(limit int) *HealthEvents {
+	if limit <= 0 {
+		limit = defaultHealthEventLimit
+	}
+	return &HealthEvents{limit: limit, subs: make(map[chan HealthEvent]struct{})}
+}
+
+// record numbers ev, stores it and hands it to every subscriber. A
+// subscriber that has fallen behind misses it; event IDs show the gap.
+func (e *HealthEvents) record(ev HealthEvent) HealthEvent {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.lastID++
+	ev.ID = e.lastID
+	if len(e.ring) == e.limit {
+		e.ring = append(e.ring[:0], e.ring[1:]...)
+	}
+	e.ring = append(e.ring, ev)
+	for ch := range e.subs {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+	return ev
+}
+
+// Since returns the stored events with an ID above id, oldest first.
+func (e *HealthEvents) Since(id int64) []HealthEvent {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	out := make([]HealthEvent, 0, len(e.ring))
+	for _, ev := range e.ring {
+		if ev.ID > id {
+			out = append(out, ev)
+		}
+	}
+	return out
+}
+
+// Subscribe returns a channel that receives new events until cancel is
+// called or Close closes it.
+func (e *HealthEvents) Subscribe() (events <-chan HealthEvent, cancel func()) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	ch := make(chan HealthEvent, healthEventBuffer)
+	if e.closed {
+		close(ch)
+		return ch, func() {}
+	}
+	e.subs[ch] = struct{}{}
+	return ch, func() {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		if _, ok := e.subs[ch]; ok {
+			delete(e.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// Close ends every subscription, e.g. so that event streams do not hold up
+// a graceful shutdown.
+func (e *HealthEvents) Close() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.closed = true
+	for ch := range e.subs {
+		delete(e.subs, ch)
+		close(ch)
+	}
+}
+
+// recordTransition records that b went UP or DOWN, logs it once and sends
+// it to the webhooks, along with the route going down or coming back when b
+// is its last or first healthy backend.
+func (lb *LoadBalancer) recordTransition(ctx context.Context, route string, pool *BackendPool, b *Backend, alive bool, reason string) {
+	state, typ := "DOWN", EventBackendDown
+	if alive {
+		state, typ = "UP", EventBackendUp
+	}
+	ev := lb.events.record(HealthEvent{
+		Time:    time.Now().UTC(),
+		Route:   route,
+		Backend: b.URL.String(),
+		State:   state,
+		Reason:  reason,
+	})
+	lb.webhooks.notify(WebhookEvent{Type: typ, Time: ev.Time, Route: route, Backend: ev.Backend, Reason: reason})
+	healthy := 0
+	for _, other := range pool.Backends {
+		if other.IsAlive() {
+			healthy++
+		}
+	}
+	switch {
+	case !alive && healthy == 0:
+		lb.webhooks.notify(WebhookEvent{Type: EventRouteDown, Time: ev.Time, Route: route, Reason: "no healthy backends"})
+	case alive && healthy == 1:
+		lb.webhooks.notify(WebhookEvent{Type: EventRouteUp, Time: ev.Time, Route: route, Reason: ev.Backend + " is up"})
+	}
+	fields := map[string]string{
+		"route":   route,
+		"backend": b.URL.String(),
+		"state":   state,
+	}
+	if alive {
+		logger.Info(ctx, "Backend is up", fields)
+		return
+	}
+	fields["reason"] = reason
+	logger.Error(ctx, "Backend is down", fields)
+}
+
+// HealthEvents returns the recorder of backend UP/DOWN transitions.
+func (lb *LoadBalancer) HealthEvents() *HealthEvents {
+	return lb.events
+}
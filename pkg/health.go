@@ -0,0 +1,451 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shashankk204/load_balancer/pkg/logger"
+)
+
+const (
+	HealthHTTP = "http" // an HTTP request, judged by status and body
+	HealthTCP  = "tcp"  // a TCP connection
+	HealthTLS  = "tls"  // a TCP connection and TLS handshake
+	HealthGRPC = "grpc" // the grpc.health.v1 Check call, over TLS for https backends
+
+	healthTick    = 100 * time.Millisecond // how often the scheduler looks for due checks
+	maxHealthBody = 64 << 10               // bytes of a health check response matched against expect_body
+)
+
+// HealthCheckConfig controls the active health checks of backends. The
+// health settings hold the defaults; a route's health_check overrides the
+// fields it sets.
+type HealthCheckConfig struct {
+	Type            string            `json:"type,omitempty" help:"health check type: http, tcp, tls or grpc"`
+	Host            string            `json:"host,omitempty" help:"host checked instead of the backend's"`
+	Port            int               `json:"port,omitempty" help:"port checked instead of the backend's"`
+	TLSSkipVerify   *bool             `json:"tls_skip_verify,omitempty" help:"accept any certificate in tls, grpc and https checks"` // a route's false turns verification back on
+	GRPCService     string            `json:"grpc_service,omitempty" help:"service name sent in grpc checks, empty for the whole server"`
+	Path            string            `json:"path,omitempty" help:"path requested on every backend"`
+	Method          string            `json:"method,omitempty" help:"HTTP method of health checks"`
+	Headers         map[string]string `json:"headers,omitempty"` // Host sets the request's host
+	ExpectStatus    string            `json:"expect_status,omitempty" help:"healthy status codes, e.g. 200-299,301 or 2xx"`
+	ExpectBody      string            `json:"expect_body,omitempty" help:"text a healthy response body contains"`
+	ExpectBodyRegex string            `json:"expect_body_regex,omitempty" help:"regular expression a healthy response body matches"`
+	Interval        Duration          `json:"interval,omitempty" help:"time between health checks"`
+	Timeout         Duration          `json:"timeout,omitempty" help:"time a backend has to answer a health check"`
+	Jitter          Duration          `json:"jitter,omitempty" help:"random delay of up to this much added to each interval"`
+	Rise            int               `json:"rise,omitempty" help:"consecutive passed checks before a down backend is up"`
+	Fall            int               `json:"fall,omitempty" help:"consecutive failed checks before an up backend is down"`
+}
+
+// validate checks the fields that are set; unset ones take the defaults.
+func (c *HealthCheckConfig) validate() error {
+	if c == nil {
+		return nil
+	}
+	switch c.Type {
+	case "", HealthHTTP, HealthTCP, HealthTLS, HealthGRPC:
+	default:
+		return fmt.Errorf("unknown health check type %q", c.Type)
+	}
+	if c.Port < 0 || c.Port > 65535 {
+		return fmt.Errorf("health check port must be between 1 and 65535")
+	}
+	if c.Path != "" && !strings.HasPrefix(c.Path, "/") {
+		return fmt.Errorf("health check path must start with /")
+	}
+	if _, err := parseStatusRanges(c.ExpectStatus); err != nil {
+		return err
+	}
+	if c.ExpectBodyRegex != "" {
+		if _, err := regexp.Compile(c.ExpectBodyRegex); err != nil {
+			return fmt.Errorf("health check expect_body_regex: %w", err)
+		}
+	}
+	if c.Interval < 0 || c.Timeout < 0 || c.Jitter < 0 {
+		return fmt.Errorf("health check interval, timeout and jitter must not be negative")
+	}
+	if c.Rise < 0 || c.Fall < 0 {
+		return fmt.Errorf("health check rise and fall must not be negative")
+	}
+	return nil
+}
+
+func (c *HealthCheckConfig) skipVerify() bool {
+	return c.TLSSkipVerify != nil && *c.TLSSkipVerify
+}
+
+// withDefaults returns c with the fields it leaves unset taken from d.
+// Headers are replaced as a whole.
+func (c *HealthCheckConfig) withDefaults(d HealthCheckConfig) HealthCheckConfig {
+	if c == nil {
+		return d
+	}
+	out := *c
+	if out.Type == "" {
+		out.Type = d.Type
+	}
+	if out.Host == "" {
+		out.Host = d.Host
+	}
+	if out.Port == 0 {
+		out.Port = d.Port
+	}
+	if out.TLSSkipVerify == nil {
+		out.TLSSkipVerify = d.TLSSkipVerify
+	}
+	if out.GRPCService == "" {
+		out.GRPCService = d.GRPCService
+	}
+	if out.Path == "" {
+		out.Path = d.Path
+	}
+	if out.Method == "" {
+		out.Method = d.Method
+	}
+	if out.Headers == nil {
+		out.Headers = d.Headers
+	}
+	if out.ExpectStatus == "" {
+		out.ExpectStatus = d.ExpectStatus
+	}
+	if out.ExpectBody == "" {
+		out.ExpectBody = d.ExpectBody
+	}
+	if out.ExpectBodyRegex == "" {
+		out.ExpectBodyRegex = d.ExpectBodyRegex
+	}
+	if out.Interval == 0 {
+		out.Interval = d.Interval
+	}
+	if out.Timeout == 0 {
+		out.Timeout = d.Timeout
+	}
+	if out.Jitter == 0 {
+		out.Jitter = d.Jitter
+	}
+	if out.Rise == 0 {
+		out.Rise = d.Rise
+	}
+	if out.Fall == 0 {
+		out.Fall = d.Fall
+	}
+	return out
+}
+
+type statusRange struct{ lo, hi int }
+
+// parseStatusRanges parses a comma-separated list of status codes, ranges
+// such as 200-299 and classes such as 2xx. An empty list means 200.
+func parseStatusRanges(s string) ([]statusRange, error) {
+	if strings.TrimSpace(s) == "" {
+		return []statusRange{{200, 200}}, nil
+	}
+	var out []statusRange
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		var r statusRange
+		var err error
+		if lo, hi, ok := strings.Cut(part, "-"); ok {
+			if r.lo, err = strconv.Atoi(strings.TrimSpace(lo)); err == nil {
+				r.hi, err = strconv.Atoi(strings.TrimSpace(hi))
+			}
+		} else if len(part) == 3 && strings.HasSuffix(strings.ToLower(part), "xx") {
+			var class int
+			class, err = strconv.Atoi(part[:1])
+			r = statusRange{class * 100, class*100 + 99}
+		} else {
+			r.lo, err = strconv.Atoi(part)
+			r.hi = r.lo
+		}
+		if err != nil || r.lo < 100 || r.hi > 599 || r.lo > r.hi {
+			return nil, fmt.Errorf("health check expect_status: invalid status %q", part)
+		}
+		out = append(out, r)
+	}
+	return out, nil
+}
+
+// healthCheck is an effective health check definition, ready to run.
+type healthCheck struct {
+	HealthCheckConfig
+	status []statusRange
+	body   *regexp.Regexp
+	client *http.Client // for http and grpc checks
+}
+
+func newHealthCheck(cfg HealthCheckConfig) (*healthCheck, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	h := &healthCheck{HealthCheckConfig: cfg}
+	h.status, _ = parseStatusRanges(cfg.ExpectStatus)
+	if cfg.ExpectBodyRegex != "" {
+		h.body = regexp.MustCompile(cfg.ExpectBodyRegex)
+	}
+	if h.Type == "" {
+		h.Type = HealthHTTP
+	}
+	if h.Method == "" {
+		h.Method = http.MethodGet
+	}
+	h.Rise = max(h.Rise, 1)
+	h.Fall = max(h.Fall, 1)
+
+	transport := &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: h.skipVerify()}}
+	if h.Type == HealthGRPC {
+		transport.Protocols = new(http.Protocols)
+		transport.Protocols.SetHTTP2(true)
+		transport.Protocols.SetUnencryptedHTTP2(true)
+	}
+	h.client = &http.Client{
+		Transport: transport,
+		// Redirects are not followed, so that expect_status sees them.
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	return h, nil
+}
+
+// target returns the address and URL a check of b goes to: the backend's,
+// with host and port replaced as configured.
+func (h *healthCheck) target(b *Backend) (string, *url.URL) {
+	u := *b.URL
+	host, port := u.Hostname(), u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	if h.Host != "" {
+		host = h.Host
+	}
+	if h.Port != 0 {
+		port = strconv.Itoa(h.Port)
+	}
+	u.Host = net.JoinHostPort(host, port)
+	return u.Host, &u
+}
+
+// probe sends one health check to b and returns why it failed, or nil.
+func (h *healthCheck) probe(ctx context.Context, b *Backend) error {
+	if h.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(h.Timeout))
+		defer cancel()
+	}
+	addr, u := h.target(b)
+	switch h.Type {
+	case HealthTCP:
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	case HealthTLS:
+		dialer := tls.Dialer{Config: &tls.Config{
+			ServerName:         u.Hostname(),
+			InsecureSkipVerify: h.skipVerify(),
+		}}
+		conn, err := dialer.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	case HealthGRPC:
+		return h.probeGRPC(ctx, u)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, h.Method, u.String()+h.Path, nil)
+	if err != nil {
+		return err
+	}
+	for k, v := range h.Headers {
+		if strings.EqualFold(k, "Host") {
+			req.Host = v
+			continue
+		}
+		req.Header.Set(k, v)
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if !h.statusOK(resp.StatusCode) {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	if h.ExpectBody == "" && h.body == nil {
+		return nil
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxHealthBody))
+	if err != nil {
+		return fmt.Errorf("reading body: %w", err)
+	}
+	if h.ExpectBody != "" && !bytes.Contains(body, []byte(h.ExpectBody)) {
+		return fmt.Errorf("body does not contain %q", h.ExpectBody)
+	}
+	if h.body != nil && !h.body.Match(body) {
+		return fmt.Errorf("body does not match %q", h.ExpectBodyRegex)
+	}
+	return nil
+}
+
+func (h *healthCheck) statusOK(code int) bool {
+	for _, r := range h.status {
+		if code >= r.lo && code <= r.hi {
+			return true
+		}
+	}
+	return false
+}
+
+// healthState tracks the health checks of one backend.
+type healthState struct {
+	mu        sync.Mutex
+	next      time.Time // when the next check is due
+	running   bool
+	successes int // consecutive passed checks
+	failures  int // consecutive failed checks
+}
+
+// due reports whether a check of the backend should start now, and if so
+// marks it running and schedules the next one.
+func (s *healthState) due(now time.Time, h *healthCheck) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.running || now.Before(s.next) {
+		return false
+	}
+	wait := time.Duration(h.Interval)
+	if h.Jitter > 0 {
+		wait += rand.N(time.Duration(h.Jitter))
+	}
+	s.running = true
+	s.next = now.Add(wait)
+	return true
+}
+
+// record counts the result of a check and returns whether the backend is
+// alive now: it goes down after fall consecutive failures and back up after
+// rise consecutive passes.
+func (s *healthState) record(passed, alive bool, h *healthCheck) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.running = false
+	if passed {
+		s.successes++
+		s.failures = 0
+		return alive || s.successes >= h.Rise
+	}
+	s.failures++
+	s.successes = 0
+	return alive && s.failures < h.Fall
+}
+
+// StartHealthChecks checks the backends of every route until ctx is done,
+// each route by its own health_check config on top of defaults.
+func (lb *LoadBalancer) StartHealthChecks(ctx context.Context, defaults HealthCheckConfig) {
+	lb.mux.Lock()
+	lb.healthDefaults = defaults
+	lb.mux.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(healthTick)
+		defer ticker.Stop()
+		checks := map[*BackendPool]*healthCheck{} // compiled once per pool
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			lb.mux.RLock()
+			routesSnapshot := make(map[string]*BackendPool, len(lb.Routes))
+			maps.Copy(routesSnapshot, lb.Routes)
+			lb.mux.RUnlock()
+
+			now := time.Now()
+			seen := make(map[*BackendPool]bool, len(routesSnapshot))
+			for prefix, pool := range routesSnapshot {
+				seen[pool] = true
+				check, ok := checks[pool]
+				if !ok {
+					var err error
+					if check, err = newHealthCheck(pool.HealthCheck.withDefaults(defaults)); err != nil {
+						logger.Error(context.Background(), "Invalid health check", map[string]string{
+							"route": prefix,
+							"error": err.Error(),
+						})
+					}
+					checks[pool] = check
+				}
+				if check == nil {
+					continue
+				}
+				for _, b := range pool.Backends {
+					if b.health.due(now, check) {
+						go lb.checkBackend(ctx, prefix, pool, b, check)
+					}
+				}
+			}
+			maps.DeleteFunc(checks, func(pool *BackendPool, check *healthCheck) bool {
+				if seen[pool] {
+					return false
+				}
+				if check != nil {
+					check.client.CloseIdleConnections()
+				}
+				return true
+			})
+		}
+	}()
+}
+
+func (lb *LoadBalancer) checkBackend(ctx context.Context, prefix string, pool *BackendPool, b *Backend, h *healthCheck) {
+	start := time.Now()
+	err := h.probe(ctx, b)
+	healthCheckDuration := time.Since(start)
+	if ctx.Err() != nil {
+		return // shutting down
+	}
+	var urlErr *url.Error
+	var opErr *net.OpError
+	if errors.As(err, &urlErr) || errors.As(err, &opErr) {
+		BackendFailuresTotal.WithLabelValues(prefix, b.URL.String(), b.URL.Host, "connection_error").Inc()
+	}
+
+	wasAlive := b.IsAlive()
+	isAlive := b.health.record(err == nil, wasAlive, h)
+	if isAlive && !wasAlive {
+		b.startSlowStart()
+	}
+	b.SetAlive(isAlive)
+	lb.updateBackendHealthMetrics(prefix, b, isAlive, err == nil, healthCheckDuration)
+
+	// Single failures only count in the metrics; transitions are logged.
+	logCtx := logger.WithRequestID(context.Background())
+	switch {
+	case isAlive && !wasAlive:
+		lb.recordTransition(logCtx, prefix, pool, b, true, fmt.Sprintf("%d health checks passed in a row", h.Rise))
+	case !isAlive && wasAlive:
+		lb.recordTransition(logCtx, prefix, pool, b, false, fmt.Sprintf("%d health checks failed in a row, last: %v", h.Fall, err))
+	}
+}
@@ -0,0 +1,134 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// grpcHealthPath is the method of the standard gRPC health checking
+// protocol (grpc.health.v1.Health/Check).
+const grpcHealthPath = "/grpc.health.v1.Health/Check"
+
+// gRPC health status values of HealthCheckResponse.status.
+var grpcServingStatus = map[uint64]string{
+	0: "UNKNOWN",
+	1: "SERVING",
+	2: "NOT_SERVING",
+	3: "SERVICE_UNKNOWN",
+}
+
+// probeGRPC calls grpc.health.v1.Health/Check and passes if the service is
+// SERVING. The messages have a single field each, so they are encoded by
+// hand rather than pulling in a gRPC library.
+func (h *healthCheck) probeGRPC(ctx context.Context, u *url.URL) error {
+	// HealthCheckRequest{service = 1}, in a gRPC frame: an uncompressed flag
+	// and a 4-byte length before the message.
+	var msg []byte
+	if h.GRPCService != "" {
+		msg = binary.AppendUvarint([]byte{0x0a}, uint64(len(h.GRPCService)))
+		msg = append(msg, h.GRPCService...)
+	}
+	frame := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+	frame = append(frame, msg...)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String()+grpcHealthPath, bytes.NewReader(frame))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+	for k, v := range h.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected HTTP status %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxHealthBody))
+	if err != nil {
+		return fmt.Errorf("reading response: %w", err)
+	}
+
+	// The status is in the trailers, or in the headers of a response
+	// without a message.
+	status := resp.Trailer.Get("Grpc-Status")
+	message := resp.Trailer.Get("Grpc-Message")
+	if status == "" {
+		status, message = resp.Header.Get("Grpc-Status"), resp.Header.Get("Grpc-Message")
+	}
+	if code, err := strconv.Atoi(status); err != nil || code != 0 {
+		if message == "" {
+			message = "no grpc-status"
+		}
+		return fmt.Errorf("grpc status %s: %s", status, message)
+	}
+
+	if len(body) < 5 || int(binary.BigEndian.Uint32(body[1:5])) != len(body)-5 {
+		return fmt.Errorf("malformed grpc response")
+	}
+	if body[0] != 0 {
+		return fmt.Errorf("compressed grpc response")
+	}
+	serving, err := grpcHealthStatus(body[5:])
+	if err != nil {
+		return err
+	}
+	if serving != 1 {
+		return fmt.Errorf("service is %s", grpcServingStatus[serving])
+	}
+	return nil
+}
+
+// grpcHealthStatus decodes HealthCheckResponse{status = 1}. Unknown fields
+// are skipped; a missing status is UNKNOWN.
+func grpcHealthStatus(msg []byte) (uint64, error) {
+	var status uint64
+	for len(msg) > 0 {
+		key, n := binary.Uvarint(msg)
+		if n <= 0 {
+			return 0, fmt.Errorf("malformed grpc health response")
+		}
+		msg = msg[n:]
+		switch key & 7 {
+		case 0: // varint
+			v, n := binary.Uvarint(msg)
+			if n <= 0 {
+				return 0, fmt.Errorf("malformed grpc health response")
+			}
+			msg = msg[n:]
+			if key>>3 == 1 {
+				status = v
+			}
+		case 1: // 64-bit
+			if len(msg) < 8 {
+				return 0, fmt.Errorf("malformed grpc health response")
+			}
+			msg = msg[8:]
+		case 2: // length-delimited
+			l, n := binary.Uvarint(msg)
+			if n <= 0 || uint64(len(msg)-n) < l {
+				return 0, fmt.Errorf("malformed grpc health response")
+			}
+			msg = msg[n+int(l):]
+		case 5: // 32-bit
+			if len(msg) < 4 {
+				return 0, fmt.Errorf("malformed grpc health response")
+			}
+			msg = msg[4:]
+		default:
+			return 0, fmt.Errorf("malformed grpc health response")
+		}
+	}
+	return status, nil
+}
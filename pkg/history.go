@@ -0,0 +1,233 @@
+package core
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const defaultHistoryLimit = 50
+
+// Snapshot is one version of the running configuration.
+type Snapshot struct {
+	Version int64      `json:"version"`
+	Time    time.Time  `json:"time"`
+	Author  string     `json:"author"`
+	Action  string     `json:"action"`
+	Diff    ConfigDiff `json:"diff"`
+	Config  *Config    `json:"config,omitempty"` // left out of history listings
+}
+
+// ConfigDiff is what changed from the previous snapshot.
+type ConfigDiff struct {
+	Added      []RouteConfig     `json:"added,omitempty"`
+	Removed    []RouteConfig     `json:"removed,omitempty"`
+	Updated    []RouteUpdate     `json:"updated,omitempty"`
+	ErrorPages *ErrorPagesUpdate `json:"error_pages,omitempty"`
+}
+
+type RouteUpdate struct {
+	Route  string      `json:"route"`
+	Before RouteConfig `json:"before"`
+	After  RouteConfig `json:"after"`
+}
+
+type ErrorPagesUpdate struct {
+	Before *ErrorPagesConfig `json:"before"`
+	After  *ErrorPagesConfig `json:"after"`
+}
+
+func (d ConfigDiff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Updated) == 0 && d.ErrorPages == nil
+}
+
+// diffConfig compares two configs route by route. from may be nil.
+func diffConfig(from, to *Config) ConfigDiff {
+	var d ConfigDiff
+	before := make(map[string]RouteConfig)
+	var fromPages *ErrorPagesConfig
+	if from != nil {
+		for _, r := range from.Routes {
+			before[r.Key()] = r
+		}
+		fromPages = from.ErrorPages
+	}
+	seen := make(map[string]bool, len(to.Routes))
+	for _, r := range to.Routes {
+		key := r.Key()
+		seen[key] = true
+		old, ok := before[key]
+		switch {
+		case !ok:
+			d.Added = append(d.Added, r)
+		case !configEqual(old, r):
+			d.Updated = append(d.Updated, RouteUpdate{Route: key, Before: old, After: r})
+		}
+	}
+	if from != nil {
+		for _, r := range from.Routes {
+			if !seen[r.Key()] {
+				d.Removed = append(d.Removed, r)
+			}
+		}
+	}
+	x, _ := json.Marshal(fromPages)
+	y, _ := json.Marshal(to.ErrorPages)
+	if string(x) != string(y) {
+		d.ErrorPages = &ErrorPagesUpdate{Before: fromPages, After: to.ErrorPages}
+	}
+	return d
+}
+
+// ConfigHistory keeps the most recent snapshots in memory and, when it has a
+// directory, one file per snapshot on disk so it survives restarts.
+type ConfigHistory struct {
+	mu      sync.RWMutex
+	dir     string
+	limit   int
+	entries []*Snapshot // oldest first
+}
+
+// NewConfigHistory keeps up to limit snapshots (50 if limit <= 0). With a
+// non-empty dir, snapshots already stored there are loaded.
+func NewConfigHistory(dir string, limit int) (*ConfigHistory, error) {
+	if limit <= 0 {
+		limit = defaultHistoryLimit
+	}
+	h := &ConfigHistory{dir: dir, limit: limit}
+	if dir == "" {
+		return h, nil
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "config-*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		var s Snapshot
+		if err := json.Unmarshal(data, &s); err != nil || s.Config == nil {
+			log.Printf("Skipping unreadable config snapshot %s: %v", file, err)
+			continue
+		}
+		h.entries = append(h.entries, &s)
+	}
+	slices.SortFunc(h.entries, func(a, b *Snapshot) int { return cmp.Compare(a.Version, b.Version) })
+	h.trim()
+	return h, nil
+}
+
+func (h *ConfigHistory) file(version int64) string {
+	return filepath.Join(h.dir, fmt.Sprintf("config-%08d.json", version))
+}
+
+// trim drops the oldest snapshots beyond the limit, on disk too.
+func (h *ConfigHistory) trim() {
+	for len(h.entries) > h.limit {
+		if h.dir != "" {
+			os.Remove(h.file(h.entries[0].Version))
+		}
+		h.entries = h.entries[1:]
+	}
+}
+
+func (h *ConfigHistory) add(s *Snapshot) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.entries = append(h.entries, s)
+	h.trim()
+	if h.dir == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(h.file(s.Version), append(data, '\n'))
+}
+
+func (h *ConfigHistory) latest() *Snapshot {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if len(h.entries) == 0 {
+		return nil
+	}
+	return h.entries[len(h.entries)-1]
+}
+
+// List returns the snapshots newest first, without their configs.
+func (h *ConfigHistory) List() []Snapshot {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	out := make([]Snapshot, 0, len(h.entries))
+	for i := len(h.entries) - 1; i >= 0; i-- {
+		s := *h.entries[i]
+		s.Config = nil
+		out = append(out, s)
+	}
+	return out
+}
+
+// Get returns the snapshot of version, if it is still kept.
+func (h *ConfigHistory) Get(version int64) (*Snapshot, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for _, s := range h.entries {
+		if s.Version == version {
+			return s, true
+		}
+	}
+	return nil, false
+}
+
+// SetHistory replaces the config history, e.g. with one kept on disk. The
+// version continues from the newest snapshot in it.
+func (lb *LoadBalancer) SetHistory(h *ConfigHistory) {
+	lb.persistMu.Lock()
+	defer lb.persistMu.Unlock()
+	lb.history = h
+	if s := h.latest(); s != nil && s.Version > atomic.LoadInt64(&lb.version) {
+		atomic.StoreInt64(&lb.version, s.Version)
+	}
+}
+
+func (lb *LoadBalancer) History() *ConfigHistory {
+	lb.persistMu.Lock()
+	defer lb.persistMu.Unlock()
+	return lb.history
+}
+
+// Rollback restores the config of version in one step and records that as a
+// new version.
+func (lb *LoadBalancer) Rollback(version int64, author string) (*ReloadResult, int64, error) {
+	s, ok := lb.History().Get(version)
+	if !ok {
+		return nil, 0, fmt.Errorf("version %d is not in the history", version)
+	}
+	cfg := *s.Config
+	cfg.Version = 0
+	var result *ReloadResult
+	current, err := lb.Change(author, fmt.Sprintf("rollback to version %d", version), func() error {
+		var err error
+		result, err = lb.ApplyConfig(&cfg, 0)
+		return err
+	})
+	var persistErr *PersistError
+	if err != nil && !errors.As(err, &persistErr) {
+		return nil, 0, err
+	}
+	return result, current, err
+}
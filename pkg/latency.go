@@ -0,0 +1,136 @@
+package core
+
+import (
+	"cmp"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+const (
+	LatencyEWMA     = "ewma"      // exponentially weighted moving average
+	LatencyPeakEWMA = "peak_ewma" // jumps to any slower sample, then decays
+
+	defaultLatencyDecay = 10 * time.Second
+)
+
+// LatencyConfig tunes how backend latency is tracked for least_latency, p2c
+// and the load score.
+type LatencyConfig struct {
+	Mode  string   `json:"mode,omitempty"`  // "ewma" (default) or "peak_ewma"
+	Decay Duration `json:"decay,omitempty"` // time for an old sample's weight to fall to 1/e
+}
+
+func (c *LatencyConfig) validate() error {
+	if c == nil {
+		return nil
+	}
+	switch c.Mode {
+	case "", LatencyEWMA, LatencyPeakEWMA:
+	default:
+		return fmt.Errorf("unknown latency mode %q", c.Mode)
+	}
+	if c.Decay < 0 {
+		return fmt.Errorf("latency decay must not be negative")
+	}
+	return nil
+}
+
+func (c *LatencyConfig) decay() time.Duration {
+	if c != nil && c.Decay > 0 {
+		return time.Duration(c.Decay)
+	}
+	return defaultLatencyDecay
+}
+
+func (c *LatencyConfig) peak() bool {
+	return c != nil && c.Mode == LatencyPeakEWMA
+}
+
+// LatencyTracker keeps a time-decayed average of a backend's response time.
+// Samples are weighted by how recently they arrived rather than by count, so
+// a burst of traffic does not flush the history faster than a quiet period.
+// The zero value is ready to use.
+type LatencyTracker struct {
+	mu    sync.Mutex
+	value float64 // nanoseconds
+	stamp time.Time
+}
+
+// Observe folds one response time into the average.
+func (t *LatencyTracker) Observe(cfg *LatencyConfig, rtt time.Duration) {
+	now := time.Now()
+	sample := float64(rtt.Nanoseconds())
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.stamp.IsZero() || (cfg.peak() && sample > t.value) {
+		t.value = sample
+	} else {
+		w := math.Exp(-float64(now.Sub(t.stamp)) / float64(cfg.decay()))
+		t.value = t.value*w + sample*(1-w)
+	}
+	t.stamp = now
+}
+
+// Value returns the average in milliseconds. In peak_ewma mode the value also
+// decays towards zero while no samples arrive, so a backend that was skipped
+// after a slow spell is eventually tried again.
+func (t *LatencyTracker) Value(cfg *LatencyConfig) float64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.stamp.IsZero() {
+		return 0
+	}
+	v := t.value
+	if cfg.peak() {
+		v *= math.Exp(-float64(time.Since(t.stamp)) / float64(cfg.decay()))
+	}
+	return v / 1e6
+}
+
+// cost is the p2c score of a backend: the requests it is serving, plus this
+// one, times its recent latency, per unit of weight.
+func (BP *BackendPool) cost(b *Backend) float64 {
+	lat := b.Latency.Value(BP.Latency)
+	if lat == 0 {
+		lat = 1 // no samples yet, rank by active requests alone
+	}
+	return float64(b.ActiveRequests()+1) * lat / float64(b.GetWeight())
+}
+
+// pickP2C samples two distinct selectable backends at random and returns the
+// cheaper one. Unlike scanning for the global minimum it does not send a
+// burst of requests to the same idle backend. Held backends are sampled only
+// when no other is selectable.
+func (BP *BackendPool) pickP2C(exclude []*Backend, held map[*Backend]bool) *Backend {
+	candidates := make([]*Backend, 0, len(BP.Backends))
+	var fallback *Backend
+	for _, b := range BP.Backends {
+		if !BP.isSelectable(b, exclude) {
+			continue
+		}
+		if held[b] {
+			fallback = cmp.Or(fallback, b)
+			continue
+		}
+		candidates = append(candidates, b)
+	}
+	switch len(candidates) {
+	case 0:
+		return fallback
+	case 1:
+		return candidates[0]
+	}
+	i := rand.IntN(len(candidates))
+	j := rand.IntN(len(candidates) - 1)
+	if j >= i {
+		j++
+	}
+	a, b := candidates[i], candidates[j]
+	if BP.cost(b) < BP.cost(a) {
+		return b
+	}
+	return a
+}
@@ -2,49 +2,260 @@ package core
 
 import (
 	"context"
+	"crypto/sha256"
+	"errors"
 	"fmt"
 	"log"
-	"maps"
 	"net/http"
+	"reflect"
+	"runtime/debug"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	// core "github.com/shashankk204/load_balancer/pkg"
 	"github.com/shashankk204/load_balancer/pkg/logger"
 )
 
-//TODO:
-// Add a timeout or context propagation to cancel stuck proxy calls.
-// Handle panics in backends gracefully:
+// Errors of admin changes naming a route or backend that does not exist.
+var (
+	ErrRouteNotFound   = errors.New("route not found")
+	ErrBackendNotFound = errors.New("backend not found")
+)
 
 type LoadBalancer struct {
-	Routes map[string]*BackendPool
+	Routes map[string]*BackendPool // keyed by route name, or prefix for unnamed routes
 	Trie   *Trie
 	mux    sync.RWMutex
+
+	ErrorPages *ErrorPages // global error pages, nil for the built-in JSON bodies
+
+	// prefixRoutes lists the route keys sharing each trie pattern, routes
+	// with match rules first so the unconditional one acts as the fallback.
+	prefixRoutes map[string][]string
+	order        []string // route keys in the order they were added, for exporting the config
+
+	version     int64 // config version, bumped by Persist
+	persistMu   sync.Mutex
+	history     *ConfigHistory
+	persistPath string
+	persisted   [sha256.Size]byte // digest of the last file Persist wrote
+
+	active int64 // requests being proxied, across all routes
+
+	healthDefaults HealthCheckConfig // health check settings of routes without their own
+	events         *HealthEvents
+	webhooks       *Webhooks // nil unless enabled
 }
 
 func Initialize_LB() *LoadBalancer {
 	return &LoadBalancer{
-		Routes: make(map[string]*BackendPool),
-		Trie:   NewTrie(),
+		Routes:       make(map[string]*BackendPool),
+		Trie:         NewTrie(),
+		prefixRoutes: make(map[string][]string),
+		history:      &ConfigHistory{limit: defaultHistoryLimit},
+		events:       NewHealthEvents(defaultHealthEventLimit),
+	}
+}
+
+func NewRoute(configs []BackendConfig) (*BackendPool, error) {
+	pool := &BackendPool{Backends: make([]*Backend, 0, len(configs))}
+	for _, c := range configs {
+		b, err := pool.newBackend(c)
+		if err != nil {
+			return nil, err
+		}
+		pool.Backends = append(pool.Backends, b)
 	}
+	return pool, nil
 }
 
-func NewRoute(urls []string) *BackendPool {
-	backends := make([]*Backend, 0, len(urls))
-	for _, u := range urls {
-		backends = append(backends, NewBackend(u))
+func (lb *LoadBalancer) AddRoute(prefix string, urls []string, strategy Strategy) (*BackendPool, error) {
+	return lb.AddRouteConfig(RouteConfig{Prefix: prefix, Backends: BackendURLs(urls...), Strategy: string(strategy)})
+}
+
+// AddRouteConfig creates a route from its configuration. Several routes may
+// share a prefix as long as each has a name and all but one have match rules.
+func (lb *LoadBalancer) AddRouteConfig(r RouteConfig) (*BackendPool, error) {
+	pool, _, err := newPool(r, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	lb.mux.Lock()
+	defer lb.mux.Unlock()
+	if err := lb.registerRoute(r.Key(), pool); err != nil {
+		return nil, err
 	}
-	return &BackendPool{Backends: backends}
+	return pool, nil
 }
 
-func (lb *LoadBalancer) AddRoute(prefix string, urls []string, strategy Strategy) {
-	pool := NewRoute(urls)
+// newPool builds the pool of a route without registering it. Backends of old
+// whose URL is still configured are reused with their counters and health;
+// their new settings are only applied by commit, so a config that fails
+// later on leaves the running routes untouched.
+func newPool(r RouteConfig, old *BackendPool) (pool *BackendPool, commit func(), err error) {
+	if r.Match != nil && r.Name == "" {
+		return nil, nil, fmt.Errorf("route %s has match rules and needs a name", r.Prefix)
+	}
+	rule, err := NewMatchRule(r.Match)
+	if err != nil {
+		return nil, nil, fmt.Errorf("route %s: %w", r.Key(), err)
+	}
+	strategy, ok := LookupStrategy(r.Strategy)
+	if !ok {
+		return nil, nil, fmt.Errorf("route %s: unknown strategy %q", r.Key(), r.Strategy)
+	}
+	var sticky *StickySessions
+	if old != nil && reflect.DeepEqual(old.config.Sticky, r.Sticky) {
+		sticky = old.Sticky // keep the signing key and learned sessions
+	} else if sticky, err = NewStickySessions(r.Sticky); err != nil {
+		return nil, nil, fmt.Errorf("route %s: %w", r.Key(), err)
+	}
+	pages, err := NewErrorPages(r.ErrorPages)
+	if err != nil {
+		return nil, nil, fmt.Errorf("route %s: %w", r.Key(), err)
+	}
+	if err := r.Latency.validate(); err != nil {
+		return nil, nil, fmt.Errorf("route %s: %w", r.Key(), err)
+	}
+	if err := r.SlowStart.validate(); err != nil {
+		return nil, nil, fmt.Errorf("route %s: %w", r.Key(), err)
+	}
+	if err := r.HealthCheck.validate(); err != nil {
+		return nil, nil, fmt.Errorf("route %s: %w", r.Key(), err)
+	}
+	if err := r.Outlier.validate(); err != nil {
+		return nil, nil, fmt.Errorf("route %s: %w", r.Key(), err)
+	}
+
+	pool = &BackendPool{Timeouts: r.Timeouts, Transport: r.Transport, config: r}
+	existing := map[string]*Backend{}
+	if old != nil {
+		for _, b := range old.Backends {
+			existing[b.URL.String()] = b
+		}
+	}
+	var pending []func()
+	backendFor := func(c BackendConfig) (*Backend, error) {
+		if b, ok := existing[c.URL]; ok {
+			pending = append(pending, func() { pool.configureBackend(b, c) })
+			return b, nil
+		}
+		b, err := pool.newBackend(c)
+		if err == nil && old != nil {
+			b.startSlowStart() // joins a route that is already serving
+		}
+		return b, err
+	}
+
+	var trafficSplit *TrafficSplit
+	var splitBackends []*Backend
+	if r.TrafficSplit != nil {
+		if len(r.Backends) > 0 {
+			return nil, nil, fmt.Errorf("route %s: use either backends or traffic_split groups", r.Key())
+		}
+		if trafficSplit, splitBackends, err = newTrafficSplit(r.TrafficSplit, backendFor); err != nil {
+			return nil, nil, fmt.Errorf("route %s: %w", r.Key(), err)
+		}
+	}
+
+	for _, c := range r.Backends {
+		b, err := backendFor(c)
+		if err != nil {
+			return nil, nil, fmt.Errorf("route %s: %w", r.Key(), err)
+		}
+		pool.Backends = append(pool.Backends, b)
+	}
+	pool.Prefix = r.Prefix
+	pool.Match = rule
 	pool.Strategy = strategy
-	lb.Routes[prefix] = pool
-	lb.Trie.Insert(prefix)
+	pool.Retry = r.Retry
+	pool.CircuitBreaker = r.CircuitBreaker
+	pool.Outlier = r.Outlier
+	pool.Hash = r.Hash
+	pool.Sticky = sticky
+	pool.ErrorPages = pages
+	pool.Latency = r.Latency
+	pool.SlowStart = r.SlowStart
+	pool.HealthCheck = r.HealthCheck
+	if r.TrafficSplit != nil {
+		pool.Backends = splitBackends
+		pool.Split = trafficSplit
+		trafficSplit.inherit(pool)
+	}
+	commit = func() {
+		for _, apply := range pending {
+			apply()
+		}
+	}
+	return pool, commit, nil
+}
+
+// registerRoute adds a built pool to the routing table under key.
+func (lb *LoadBalancer) registerRoute(key string, pool *BackendPool) error {
+	if _, exists := lb.Routes[key]; exists {
+		return fmt.Errorf("route %s already exists", key)
+	}
+	if pool.Match == nil {
+		for _, other := range lb.prefixRoutes[pool.Prefix] {
+			if lb.Routes[other].Match == nil {
+				return fmt.Errorf("route %s: prefix %s already has an unconditional route %s", key, pool.Prefix, other)
+			}
+		}
+	}
+	if err := lb.insertRoute(key, pool.Prefix, pool.Match != nil); err != nil {
+		return err
+	}
+	if pool.Split != nil {
+		for _, g := range pool.Split.Groups[1:] {
+			RouteGroupPercent.WithLabelValues(key, g.Name).Set(float64(g.Percent()))
+		}
+	}
+	lb.Routes[key] = pool
+	lb.order = append(lb.order, key)
+	return nil
+}
+
+// insertRoute adds prefix to the trie, registers the route key under it and
+// reports routes it overlaps with.
+func (lb *LoadBalancer) insertRoute(key, prefix string, conditional bool) error {
+	if err := lb.Trie.Insert(prefix); err != nil {
+		return err
+	}
+	for _, other := range lb.Trie.Overlapping(prefix) {
+		log.Printf("Route %s overlaps %s; literal segments take priority over :params, and :params over **", prefix, other)
+	}
+	keys := lb.prefixRoutes[prefix]
+	if conditional {
+		// Keep conditional routes ahead of the unconditional fallback.
+		i := len(keys)
+		if i > 0 && lb.Routes[keys[i-1]] != nil && lb.Routes[keys[i-1]].Match == nil {
+			i--
+		}
+		keys = slices.Insert(keys, i, key)
+	} else {
+		keys = append(keys, key)
+	}
+	lb.prefixRoutes[prefix] = keys
+	return nil
+}
+
+// findRoute returns the route for req: the longest matching prefix whose
+// match rules accept the request, falling back to shorter prefixes.
+func (lb *LoadBalancer) findRoute(req *http.Request) (string, RouteMatch, bool) {
+	for _, m := range lb.Trie.MatchAll(req.URL.Path) {
+		for _, key := range lb.prefixRoutes[m.Pattern] {
+			if pool, ok := lb.Routes[key]; ok && pool.Match.Matches(req) {
+				m.Route = key
+				return key, m, true
+			}
+		}
+	}
+	return "", RouteMatch{}, false
 }
 
 // This is a Response Writer Wrapper pattern used to intercept and capture HTTP response details that are normally not accessible after the response is sent.
@@ -52,14 +263,25 @@ type responseWriterWrapper struct {
 	http.ResponseWriter
 	statusCode   int
 	responseSize int64
+	wroteHeader  bool
+	beforeHeader func(http.Header) // last chance to edit headers, e.g. sticky cookies
 }
 
 func (w *responseWriterWrapper) WriteHeader(statusCode int) {
+	if informational(statusCode) {
+		w.ResponseWriter.WriteHeader(statusCode)
+		return
+	}
 	w.statusCode = statusCode
+	w.wroteHeader = true
+	if w.beforeHeader != nil {
+		w.beforeHeader(w.ResponseWriter.Header())
+	}
 	w.ResponseWriter.WriteHeader(statusCode)
 }
 
 func (w *responseWriterWrapper) Write(data []byte) (int, error) {
+	w.wroteHeader = true
 	n, err := w.ResponseWriter.Write(data)
 	w.responseSize += int64(n)
 	return n, err
@@ -69,54 +291,146 @@ func (lb *LoadBalancer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	start := time.Now()
 	ctx := logger.WithRequestID(req.Context())
 
+	responseWrapper := &responseWriterWrapper{
+		ResponseWriter: w,
+		statusCode:     http.StatusOK,
+		responseSize:   0,
+	}
+	route := "unknown"
+	var pages, global *ErrorPages
+	defer func() {
+		if p := recover(); p != nil {
+			lb.handlePanic(ctx, responseWrapper, req, route, p, pages, global)
+		}
+	}()
+
+	// Reloads and admin changes replace pools instead of editing them, so the
+	// lock is only needed to look the route up, not while proxying.
 	lb.mux.RLock()
-	defer lb.mux.RUnlock()
-	ok, prefix := lb.Trie.MatchPrefix(req.URL.Path)
+	global = lb.ErrorPages
+	prefix, match, ok := lb.findRoute(req)
+	BP := lb.Routes[prefix]
+	lb.mux.RUnlock()
 	if ok {
-		BP := lb.Routes[prefix]
+		route, pages = prefix, BP.ErrorPages
+		ctx = WithRouteMatch(ctx, match)
+		if total := BP.Timeouts.total(); total > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, total)
+			defer cancel()
+		}
+		req = req.WithContext(ctx)
+		req.Header = req.Header.Clone()
+		forwardParams(req.Header, match)
 
 		RouteActiveRequests.WithLabelValues(prefix).Inc()
 		defer RouteActiveRequests.WithLabelValues(prefix).Dec()
+		atomic.AddInt64(&lb.active, 1)
+		defer atomic.AddInt64(&lb.active, -1)
 
 		if req.ContentLength > 0 {
 			RouteRequestSize.WithLabelValues(prefix).Observe(float64(req.ContentLength))
 		}
 		clientIP := strings.Split(req.RemoteAddr, ":")[0]
-		target := BP.GetNextBackend(clientIP);
-		if target == nil {
-			RouteErrorsTotal.WithLabelValues(prefix, "no_backend_available").Inc()
-			logger.Error(ctx, "No backend available", map[string]string{
-				"method": req.Method,
-				"path":   req.URL.Path,
-			})
-			http.Error(w, "No Backend availabe", http.StatusServiceUnavailable)
-			return
+
+		if BP.Split != nil {
+			group := BP.Split.Pick(req, clientIP)
+			RouteGroupRequestsTotal.WithLabelValues(prefix, group.Name).Inc()
+			BP = group.Pool
+		}
+		affinityKey := requestKey(BP.Hash.key(), req, clientIP)
+
+		maxAttempts := BP.Retry.maxAttempts()
+		if maxAttempts > 1 {
+			replayable, err := bufferBody(req, BP.Retry.bodyLimit())
+			if err != nil {
+				RouteErrorsTotal.WithLabelValues(prefix, "bad_request").Inc()
+				writeErrorPage(ctx, responseWrapper, req, prefix, http.StatusBadRequest, "Failed to read request body", pages, global)
+				return
+			}
+			if !replayable {
+				maxAttempts = 1
+			}
 		}
 
-		target.IncActive()
-		BackendActiveConnections.WithLabelValues(prefix, target.URL.String(), target.URL.Host).Inc()
-		defer BackendActiveConnections.WithLabelValues(prefix, target.URL.String(), target.URL.Host).Dec()
-		defer target.DecActive()
+		var tried []*Backend
+		var target *Backend
+		var last *attemptState
+		if BP.Sticky != nil {
+			responseWrapper.beforeHeader = func(h http.Header) {
+				if responseWrapper.statusCode < 500 {
+					BP.Sticky.Apply(h, req, target)
+				}
+			}
+		}
+		for attempt := 1; ; attempt++ {
+			target = nil
+			if attempt == 1 && BP.Sticky != nil {
+				target = lb.stickyTarget(prefix, BP, req)
+			}
+			if target == nil {
+				target = BP.GetNextBackend(affinityKey, tried...)
+			}
+			if target == nil {
+				if attempt == 1 {
+					RouteErrorsTotal.WithLabelValues(prefix, "no_backend_available").Inc()
+					logger.Error(ctx, "No backend available", map[string]string{
+						"method": req.Method,
+						"path":   req.URL.Path,
+					})
+					writeErrorPage(ctx, responseWrapper, req, prefix, http.StatusServiceUnavailable, "No backend available", pages, global)
+					return
+				}
+				// The previous attempt was swallowed for a retry that can no longer happen.
+				target = tried[len(tried)-1]
+				status := http.StatusBadGateway
+				if last.err != nil {
+					status = statusForError(req, last.err)
+				}
+				writeErrorPage(ctx, responseWrapper, req, prefix, status, errorMessage(status), pages, global)
+				break
+			}
+			tried = append(tried, target)
 
-		BackendSelectionTotal.WithLabelValues(prefix, target.URL.String(), target.URL.Host, string(BP.Strategy)).Inc()
+			if attempt > 1 && req.GetBody != nil {
+				req.Body, _ = req.GetBody()
+			}
+			canRetry := attempt < maxAttempts && BP.HasSelectable(tried...)
+			retry, st := lb.proxyAttempt(ctx, responseWrapper, req, prefix, BP, target, canRetry, global)
+			if !retry {
+				break
+			}
+			last = st
 
-		responseWrapper := &responseWriterWrapper{
-			ResponseWriter: w,
-			statusCode:     http.StatusOK,
-			responseSize:   0,
-		}
+			reason := "server_error"
+			if st.err != nil {
+				reason = classifyProxyError(st.err)
+			}
+			RouteRetriesTotal.WithLabelValues(prefix, reason).Inc()
+			logger.Info(ctx, "Retrying request", map[string]string{
+				"method": req.Method,
+				"path":   req.URL.Path,
+				"target": target.URL.String(),
+				"reason": reason,
+			})
 
-		proxy := target.ReverseProxy
-		proxy.ServeHTTP(responseWrapper, req)
+			if wait := BP.Retry.backoff(attempt); wait > 0 {
+				select {
+				case <-time.After(wait):
+				case <-req.Context().Done():
+				}
+			}
+			if err := req.Context().Err(); err != nil {
+				status := statusForError(req, err)
+				writeErrorPage(ctx, responseWrapper, req, prefix, status, errorMessage(status), pages, global)
+				break
+			}
+		}
 
 		duration := time.Since(start)
-		target.RecordRequest(duration)
-
 		statusCode := responseWrapper.statusCode
 		responseSize := responseWrapper.responseSize
 
-		lb.updateBackendMetrics(prefix, target, duration, statusCode)
-
 		RouteRequestsTotal.WithLabelValues(prefix, req.Method, strconv.Itoa(statusCode)).Inc()
 		RouteRequestDuration.WithLabelValues(prefix, req.Method).Observe(duration.Seconds())
 
@@ -126,7 +440,12 @@ func (lb *LoadBalancer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 
 		if statusCode >= 400 {
 			errorType := "client_error"
-			if statusCode >= 500 {
+			switch {
+			case statusCode == http.StatusGatewayTimeout:
+				errorType = "timeout"
+			case statusCode == statusClientClosedRequest:
+				errorType = "client_closed"
+			case statusCode >= 500:
 				errorType = "server_error"
 			}
 			RouteErrorsTotal.WithLabelValues(prefix, errorType).Inc()
@@ -137,17 +456,107 @@ func (lb *LoadBalancer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 			"path":     req.URL.Path,
 			"target":   target.URL.String(),
 			"duration": duration.String(),
+			"params":   match.String(),
 		})
-		log.Printf("[%s] %s -> %s [strategy=%s] in %v (avg %.2f ms, active %d)", req.Method, req.URL.Path, target.URL, BP.Strategy, duration, target.AvgLatency(), target.ActiveRequests())
+		log.Printf("[%s] %s -> %s [strategy=%s] in %v (avg %.2f ms, active %d, attempts %d)", req.Method, req.URL.Path, target.URL, BP.Strategy, duration, target.AvgLatency(), target.ActiveRequests(), len(tried))
 
 		return
 
 	}
 	RouteErrorsTotal.WithLabelValues("unknown", "route_not_found").Inc()
-	http.Error(w, "No backend found for route", http.StatusNotFound)
+	writeErrorPage(ctx, responseWrapper, req, "", http.StatusNotFound, "No backend found for route", global)
 }
 
-func (lb *LoadBalancer) updateBackendMetrics(routePrefix string, backend *Backend, duration time.Duration, statusCode int) {
+// handlePanic turns a panic in the proxy path into a 500 response. When the
+// response has already started the connection is aborted instead, so the
+// client sees a truncated response rather than a corrupted one.
+func (lb *LoadBalancer) handlePanic(ctx context.Context, w *responseWriterWrapper, req *http.Request, route string, p any, pages ...*ErrorPages) {
+	if p == http.ErrAbortHandler {
+		panic(p) // deliberate abort, e.g. by ReverseProxy when the copy fails
+	}
+	PanicsTotal.WithLabelValues(route).Inc()
+	logger.Error(ctx, "Recovered from panic", map[string]string{
+		"method": req.Method,
+		"path":   req.URL.Path,
+		"error":  fmt.Sprint(p),
+		"stack":  string(debug.Stack()),
+	})
+	if w.wroteHeader {
+		panic(http.ErrAbortHandler)
+	}
+	writeErrorPage(ctx, w, req, route, http.StatusInternalServerError, errorMessage(http.StatusInternalServerError), pages...)
+}
+
+// stickyTarget returns the backend the request is pinned to while it can
+// still be selected. A pin that cannot be honoured is counted as a re-pin;
+// the response then pins the client to the newly chosen backend.
+func (lb *LoadBalancer) stickyTarget(prefix string, BP *BackendPool, req *http.Request) *Backend {
+	pinned, hadPin := BP.Sticky.Pinned(req, BP)
+	if pinned != nil && BP.isSelectable(pinned, nil) {
+		return pinned
+	}
+	if hadPin {
+		StickyRepinsTotal.WithLabelValues(prefix).Inc()
+	}
+	return nil
+}
+
+// proxyAttempt sends req to a single backend. When canRetry is set and the
+// attempt fails in a retryable way, nothing is written to w and retry is true.
+func (lb *LoadBalancer) proxyAttempt(ctx context.Context, w http.ResponseWriter, req *http.Request, prefix string, BP *BackendPool, target *Backend, canRetry bool, global *ErrorPages) (retry bool, st *attemptState) {
+	start := time.Now()
+
+	target.IncActive()
+	BackendActiveConnections.WithLabelValues(prefix, target.URL.String(), target.URL.Host).Inc()
+	defer BackendActiveConnections.WithLabelValues(prefix, target.URL.String(), target.URL.Host).Dec()
+	defer target.DecActive()
+
+	BackendSelectionTotal.WithLabelValues(prefix, target.URL.String(), target.URL.Host, string(BP.Strategy)).Inc()
+
+	if changed, state := target.Breaker.Begin(BP.CircuitBreaker); changed {
+		lb.updateCircuitMetrics(ctx, prefix, target, state)
+	}
+
+	st = &attemptState{route: prefix, pages: []*ErrorPages{BP.ErrorPages, global}}
+	tryCtx := context.WithValue(req.Context(), attemptStateKey{}, st)
+	timeouts := target.Timeouts()
+	timeout := timeouts.total()
+	if BP.Retry != nil && BP.Retry.PerTryTimeout > 0 && (timeout == 0 || time.Duration(BP.Retry.PerTryTimeout) < timeout) {
+		timeout = time.Duration(BP.Retry.PerTryTimeout)
+	}
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		tryCtx, cancel = context.WithTimeout(tryCtx, timeout)
+		defer cancel()
+	}
+
+	aw := newAttemptWriter(w, st, BP.Retry, req.Method, canRetry)
+	target.ReverseProxy.ServeHTTP(aw, req.WithContext(tryCtx))
+
+	duration := time.Since(start)
+	target.RecordRequest(duration)
+	if clientGone(req, st.err) {
+		// Says nothing about the backend: keep it out of latency and breaker stats.
+		target.Breaker.Cancel(BP.CircuitBreaker)
+		BackendRequestsTotal.WithLabelValues(prefix, target.URL.String(), target.URL.Host, strconv.Itoa(aw.status)).Inc()
+		return false, st
+	}
+	target.Latency.Observe(BP.Latency, duration)
+	lb.updateBackendMetrics(ctx, prefix, BP, target, duration, aw.status, st.err)
+
+	if st.err != nil {
+		logger.Error(ctx, "Proxy attempt failed", map[string]string{
+			"method":   req.Method,
+			"path":     req.URL.Path,
+			"target":   target.URL.String(),
+			"duration": duration.String(),
+			"error":    st.err.Error(),
+		})
+	}
+	return aw.discarded, st
+}
+
+func (lb *LoadBalancer) updateBackendMetrics(ctx context.Context, routePrefix string, pool *BackendPool, backend *Backend, duration time.Duration, statusCode int, proxyErr error) {
 	backendURL := backend.URL.String()
 	backendHost := backend.URL.Host
 
@@ -157,18 +566,65 @@ func (lb *LoadBalancer) updateBackendMetrics(routePrefix string, backend *Backen
 
 	// Update load score (active requests + normalized latency)
 	active := float64(backend.ActiveRequests())
-	latency := backend.AvgLatency()
+	latency := backend.Latency.Value(pool.Latency)
 	loadScore := active + (latency / 100)
 	BackendLoadScore.WithLabelValues(routePrefix, backendURL, backendHost).Set(loadScore)
+	BackendLatencyEWMA.WithLabelValues(routePrefix, backendURL, backendHost).Set(latency / 1e3)
+	if pool.SlowStart != nil {
+		BackendSlowStartFactor.WithLabelValues(routePrefix, backendURL, backendHost).Set(backend.SlowStartFactor(pool.SlowStart))
+	}
 
-	// Record backend failures if status code indicates failure
-	if statusCode >= 500 {
+	// Record backend failures if the transport failed or status code indicates failure
+	if proxyErr != nil {
+		failureType := classifyProxyError(proxyErr)
+		BackendFailuresTotal.WithLabelValues(routePrefix, backendURL, backendHost, failureType).Inc()
+	} else if statusCode >= 500 {
 		failureType := "server_error"
 		BackendFailuresTotal.WithLabelValues(routePrefix, backendURL, backendHost, failureType).Inc()
 	}
+
+	// Feed the same outcome into the passive circuit breaker
+	failed := proxyErr != nil || statusCode >= 500
+	if changed, state := backend.Breaker.Record(pool.CircuitBreaker, failed); changed {
+		lb.updateCircuitMetrics(ctx, routePrefix, backend, state)
+	}
+
+	// And into outlier detection, which may eject it from the pool
+	if e := pool.recordOutlier(backend, statusCode, proxyErr != nil); e != nil {
+		lb.reportEjection(ctx, routePrefix, e)
+	}
+	for _, e := range pool.sweepOutliers(time.Now()) {
+		lb.reportEjection(ctx, routePrefix, e)
+	}
 }
 
-func (lb *LoadBalancer) updateBackendHealthMetrics(routePrefix string, backend *Backend, isAlive bool, healthCheckDuration time.Duration) {
+func (lb *LoadBalancer) updateCircuitMetrics(ctx context.Context, routePrefix string, backend *Backend, state CircuitState) {
+	BackendCircuitState.WithLabelValues(routePrefix, backend.URL.String(), backend.URL.Host).Set(float64(state))
+	logger.Info(ctx, "Circuit breaker state changed", map[string]string{
+		"route":   routePrefix,
+		"backend": backend.URL.String(),
+		"state":   state.String(),
+	})
+	switch state {
+	case CircuitOpen:
+		lb.webhooks.notify(WebhookEvent{Type: EventCircuitOpen, Route: routePrefix, Backend: backend.URL.String()})
+	case CircuitClosed:
+		lb.webhooks.notify(WebhookEvent{Type: EventCircuitClosed, Route: routePrefix, Backend: backend.URL.String()})
+	}
+}
+
+func (lb *LoadBalancer) reportEjection(ctx context.Context, routePrefix string, e *ejection) {
+	backend := e.backend
+	BackendOutlierEjectionsTotal.WithLabelValues(routePrefix, backend.URL.String(), backend.URL.Host, e.reason).Inc()
+	logger.Error(ctx, "Backend ejected as an outlier", map[string]string{
+		"route":    routePrefix,
+		"backend":  backend.URL.String(),
+		"reason":   e.reason,
+		"duration": e.duration.String(),
+	})
+}
+
+func (lb *LoadBalancer) updateBackendHealthMetrics(routePrefix string, backend *Backend, isAlive, passed bool, healthCheckDuration time.Duration) {
 	backendURL := backend.URL.String()
 	backendHost := backend.URL.Host
 
@@ -177,6 +633,8 @@ func (lb *LoadBalancer) updateBackendHealthMetrics(routePrefix string, backend *
 		BackendHealthStatus.WithLabelValues(routePrefix, backendURL, backendHost).Set(1)
 	} else {
 		BackendHealthStatus.WithLabelValues(routePrefix, backendURL, backendHost).Set(0)
+	}
+	if !passed {
 		BackendHealthCheckFailures.WithLabelValues(routePrefix, backendURL, backendHost).Inc()
 	}
 
@@ -184,80 +642,78 @@ func (lb *LoadBalancer) updateBackendHealthMetrics(routePrefix string, backend *
 	BackendHealthCheckDuration.WithLabelValues(routePrefix, backendURL, backendHost).Observe(healthCheckDuration.Seconds())
 }
 
-func (lb *LoadBalancer) StartHealthChecks(interval time.Duration, healthPath string) {
-	client := &http.Client{Timeout: 2 * time.Second}
-	ticker := time.NewTicker(interval)
-
-	go func() {
-		for range ticker.C {
-			lb.mux.RLock()
-			routesSnapshot := make(map[string]*BackendPool, len(lb.Routes))
-			maps.Copy(routesSnapshot, lb.Routes)
-			lb.mux.RUnlock()
-			for prefix, pool := range routesSnapshot {
-				for _, b := range pool.Backends {
-					go func(b *Backend, prefix string) {
-						ctx := logger.WithRequestID(context.Background())
-						healthURL := b.URL.String() + healthPath
-						start := time.Now()
-						resp, err := client.Get(healthURL)
-						healthCheckDuration := time.Since(start)
-						isAlive := err == nil && resp != nil && resp.StatusCode == http.StatusOK
-						if resp != nil {
-							resp.Body.Close()
-						}
-						if !isAlive && err != nil {
-							failureType := "connection_error"
-							BackendFailuresTotal.WithLabelValues(prefix, b.URL.String(), b.URL.Host, failureType).Inc()
-						}
-						b.SetAlive(isAlive)
-						lb.updateBackendHealthMetrics(prefix, b, isAlive, healthCheckDuration)
-						status := "DOWN"
-						if isAlive {
-							status = "UP"
-						}
-						logger.Info(ctx, "Health check result", map[string]string{
-							"path":   healthURL,
-							"target": b.URL.String(),
-							"method": "GET",
-							"status": status,
-						})
-					}(b, prefix)
-				}
-			}
-
-		}
-	}()
-}
-
-func (lb *LoadBalancer) AddBackendToRoute(prefix string, backendURL string, strategy Strategy) error {
+func (lb *LoadBalancer) AddBackendToRoute(prefix string, backend BackendConfig, strategy Strategy) error {
 	lb.mux.Lock()
 	defer lb.mux.Unlock()
 
 	pool, exists := lb.Routes[prefix]
+	if exists && pool.Split != nil {
+		return fmt.Errorf("route %s uses a traffic split; change its groups instead", prefix)
+	}
 	if !exists {
-		pool = NewRoute([]string{backendURL})
+		var err error
+		if pool, err = NewRoute([]BackendConfig{backend}); err != nil {
+			return err
+		}
+		pool.Prefix = prefix
 		pool.Strategy = strategy
-		lb.Routes[prefix] = pool
-		lb.Trie.Insert(prefix);
-		log.Printf("Created new route %s with backend %s", prefix, backendURL)
+		pool.config = RouteConfig{Prefix: prefix, Backends: []BackendConfig{backend}, Strategy: string(strategy)}
+		if err := lb.registerRoute(prefix, pool); err != nil {
+			return err
+		}
+		log.Printf("Created new route %s with backend %s", prefix, backend.URL)
 		return nil
 	}
 
-	newBackend := NewBackend(backendURL)
-	pool.Backends = append(pool.Backends, newBackend)
-	log.Printf("Added new backend %s to route %s", backendURL, prefix)
+	b, err := pool.newBackend(backend)
+	if err != nil {
+		return err
+	}
+	b.startSlowStart()
+	pool = pool.clone()
+	pool.Backends = append(pool.Backends, b)
+	pool.config.Backends = append(slices.Clone(pool.config.Backends), backend)
+	lb.Routes[prefix] = pool
+	log.Printf("Added new backend %s to route %s", backend.URL, prefix)
 	return nil
 }
 
-func (lb *LoadBalancer) RemoveBackendFromRoute(prefix string, backendURL string) {
+// SetBackendWeight changes the weight of a live backend. Counters and the
+// weighted round robin position of the pool are kept.
+func (lb *LoadBalancer) SetBackendWeight(prefix string, backendURL string, weight int) error {
+	if weight < 1 {
+		return fmt.Errorf("weight must be at least 1, got %d", weight)
+	}
+	lb.mux.Lock()
+	defer lb.mux.Unlock()
+
+	pool, ok := lb.Routes[prefix]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrRouteNotFound, prefix)
+	}
+	for _, b := range pool.Backends {
+		if b.URL.String() == backendURL {
+			b.SetWeight(weight)
+			pool.config.setBackendWeight(backendURL, weight)
+			log.Printf("Set weight of backend %s on route %s to %d", backendURL, prefix, weight)
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s on route %s", ErrBackendNotFound, backendURL, prefix)
+}
+
+// RemoveBackendFromRoute takes a backend out of a route, and out of its
+// traffic split group if the route has one.
+func (lb *LoadBalancer) RemoveBackendFromRoute(prefix string, backendURL string) error {
 	lb.mux.Lock()
 	defer lb.mux.Unlock()
 
 	pool, exists := lb.Routes[prefix]
 	if !exists {
-		log.Printf("Route %s does not exist", prefix)
-		return
+		return fmt.Errorf("%w: %s", ErrRouteNotFound, prefix)
+	}
+	if !slices.ContainsFunc(pool.Backends, func(b *Backend) bool { return b.URL.String() == backendURL }) {
+		return fmt.Errorf("%w: %s on route %s", ErrBackendNotFound, backendURL, prefix)
 	}
 
 	filtered := []*Backend{}
@@ -267,50 +723,197 @@ func (lb *LoadBalancer) RemoveBackendFromRoute(prefix string, backendURL string)
 		}
 	}
 
+	pool = pool.clone()
 	pool.Backends = filtered
+	if pool.Split != nil {
+		for _, g := range pool.Split.Groups {
+			kept := []*Backend{}
+			for _, b := range g.Pool.Backends {
+				if b.URL.String() != backendURL {
+					kept = append(kept, b)
+				}
+			}
+			g.Pool.Backends = kept
+		}
+	}
+	pool.config.removeBackend(backendURL)
+	lb.Routes[prefix] = pool
 	log.Printf("Removed backend %s from route %s", backendURL, prefix)
+	return nil
+}
+
+// ActiveRequests returns the number of requests being proxied.
+func (lb *LoadBalancer) ActiveRequests() int64 {
+	return atomic.LoadInt64(&lb.active)
+}
+
+// WaitIdle waits until no request is being proxied or ctx is done, and
+// returns the number still in flight.
+func (lb *LoadBalancer) WaitIdle(ctx context.Context) int64 {
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		active := lb.ActiveRequests()
+		if active == 0 {
+			return 0
+		}
+		select {
+		case <-ctx.Done():
+			return active
+		case <-ticker.C:
+		}
+	}
 }
 
+// RoutePrefix returns the path prefix of the route with key, or key itself
+// if there is no such route.
+func (lb *LoadBalancer) RoutePrefix(key string) string {
+	lb.mux.RLock()
+	defer lb.mux.RUnlock()
+	if pool, ok := lb.Routes[key]; ok {
+		return pool.Prefix
+	}
+	return key
+}
 
 func (lb *LoadBalancer) GetRoutesInfo() []map[string]interface{} {
 	var result []map[string]interface{}
 	lb.mux.RLock()
 	defer lb.mux.RUnlock()
 	for prefix, pool := range lb.Routes {
-		var backends []string
+		var backends []map[string]interface{}
 		for _, b := range pool.Backends {
-			backends = append(backends, b.URL.String())
+			entry := map[string]interface{}{
+				"url":                b.URL.String(),
+				"weight":             b.GetWeight(),
+				"healthy":            b.IsAlive(),
+				"circuit_state":      b.Breaker.State().String(),
+				"active_connections": b.ActiveRequests(),
+				"total_requests":     atomic.LoadInt64(&b.TotalRequests),
+				"avg_latency_ms":     b.AvgLatency(),
+				"ewma_latency_ms":    b.Latency.Value(pool.Latency),
+			}
+			if factor := b.SlowStartFactor(pool.SlowStart); factor < 1 {
+				entry["slow_start_factor"] = factor
+			}
+			if until := b.EjectedUntil(); !until.IsZero() {
+				entry["ejected_until"] = until
+			}
+			if d := b.drain.Load(); d != nil {
+				entry["drain"] = d
+			}
+			backends = append(backends, entry)
 		}
-		result = append(result, map[string]interface{}{
-			"prefix":   prefix,
+		info := map[string]interface{}{
+			"prefix":   pool.Prefix,
 			"strategy": pool.Strategy,
 			"backends": backends,
-		})
+		}
+		if prefix != pool.Prefix {
+			info["name"] = prefix
+		}
+		if pool.Match != nil {
+			info["match"] = pool.Match.Config
+		}
+		if pool.Split != nil {
+			info["traffic_split"] = pool.Split.Info()
+		}
+		info["health_check"] = pool.HealthCheck.withDefaults(lb.healthDefaults)
+		result = append(result, info)
 	}
 	return result
 }
 
-func (lb *LoadBalancer) UpdateRoute(prefix string, backends []string, strategy string) error {
+func (lb *LoadBalancer) UpdateRoute(prefix string, backends []BackendConfig, strategy string) error {
 	lb.mux.Lock()
 	defer lb.mux.Unlock()
 	pool, ok := lb.Routes[prefix]
 	if !ok {
-		return fmt.Errorf("route not found: %s", prefix)
+		return fmt.Errorf("%w: %s", ErrRouteNotFound, prefix)
 	}
 
+	if len(backends) > 0 && pool.Split != nil {
+		return fmt.Errorf("route %s uses a traffic split; change its groups instead", prefix)
+	}
+	if _, ok := LookupStrategy(strategy); !ok {
+		return fmt.Errorf("unknown strategy %q", strategy)
+	}
+	// Check every URL first so that a bad one leaves the route unchanged.
+	for _, c := range backends {
+		if _, err := ParseBackendURL(c.URL); err != nil {
+			return err
+		}
+	}
+	pool = pool.clone()
 	if len(backends) > 0 {
-		newPool := NewRoute(backends)
-		pool.Backends = newPool.Backends
+		// Keep the existing Backend (and its counters) for URLs that stay.
+		existing := make(map[string]*Backend, len(pool.Backends))
+		for _, b := range pool.Backends {
+			existing[b.URL.String()] = b
+		}
+		updated := make([]*Backend, 0, len(backends))
+		for _, c := range backends {
+			b, ok := existing[c.URL]
+			if ok {
+				pool.configureBackend(b, c)
+			} else {
+				b, _ = pool.newBackend(c) // URL checked above
+				b.startSlowStart()
+			}
+			updated = append(updated, b)
+		}
+		pool.Backends = updated
+		pool.config.Backends = slices.Clone(backends)
 	}
 	if strategy != "" {
+		pool.config.Strategy = strategy
 		oldStrategy := string(pool.Strategy)
 		newStrategy := ParseStrategy(strategy)
 		if oldStrategy != string(newStrategy) {
 			RouteStrategyChanges.WithLabelValues(prefix, oldStrategy, string(newStrategy)).Inc()
 			pool.Strategy = newStrategy
+			if pool.Split != nil {
+				pool.Split.inherit(pool)
+			}
 		}
 	}
 
 	lb.Routes[prefix] = pool
 	return nil
 }
+
+// SetGroupPercent sets the traffic share of a group on a split route by hand,
+// cancelling any canary ramp in progress.
+func (lb *LoadBalancer) SetGroupPercent(prefix string, group string, percent int) error {
+	if err := lb.setGroupPercent(prefix, group, percent, nil); err != nil {
+		return err
+	}
+	log.Printf("Set traffic share of group %s on route %s to %d%%", group, prefix, percent)
+	return nil
+}
+
+// setGroupPercent changes the share of a group both in the running split and
+// in the route's config. A canary ramp passes its slot, so the change only
+// applies while the route still runs that ramp; any other caller cancels it.
+func (lb *LoadBalancer) setGroupPercent(prefix string, group string, percent int, ramp *rampSlot) error {
+	lb.mux.Lock()
+	defer lb.mux.Unlock()
+	pool, ok := lb.Routes[prefix]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrRouteNotFound, prefix)
+	}
+	if pool.Split == nil {
+		return fmt.Errorf("route %s has no traffic split", prefix)
+	}
+	if ramp == nil {
+		pool.Split.StopCanaryRamp()
+	} else if pool.Split.ramp != ramp {
+		return errRampReplaced
+	}
+	if err := pool.Split.SetPercent(group, percent); err != nil {
+		return err
+	}
+	RouteGroupPercent.WithLabelValues(prefix, group).Set(float64(percent))
+	pool.config.setGroupPercent(group, percent)
+	return nil
+}
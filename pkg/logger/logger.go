@@ -1,15 +1,17 @@
 package logger
+
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"log"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
 )
 
-
 type LogEntry struct {
 	Timestamp string `json:"timestamp"`
 	Level     string `json:"level"`
@@ -18,23 +20,50 @@ type LogEntry struct {
 	Method    string `json:"method,omitempty"`
 	Path      string `json:"path,omitempty"`
 	Target    string `json:"target,omitempty"`
+	Route     string `json:"route,omitempty"`   // route prefix
+	Backend   string `json:"backend,omitempty"` // backend URL
+	Group     string `json:"group,omitempty"`   // traffic split group
 	Duration  string `json:"duration,omitempty"`
-	Status  string `json:"status,omitempty"`
-
+	Status    string `json:"status,omitempty"`  // HTTP status code
+	State     string `json:"state,omitempty"`   // new state of a backend, circuit or canary ramp
+	Percent   string `json:"percent,omitempty"` // traffic split share
+	Event     string `json:"event,omitempty"`   // webhook event type
+	Reason    string `json:"reason,omitempty"`
+	Error     string `json:"error,omitempty"`
+	Stack     string `json:"stack,omitempty"`
+	User      string `json:"user,omitempty"`
+	Params    string `json:"params,omitempty"` // path parameters captured by the route
 }
 
-
-
 type ctxKey string
 
 const requestIDKey ctxKey = "request_id"
 
-
 var (
 	infoLogger  = log.New(os.Stdout, "", 0)
 	errorLogger = log.New(os.Stderr, "", 0)
+
+	errorsOnly bool // level "error": Info entries are dropped
+	textFormat bool
 )
 
+// Configure sets the minimum level, "info" or "error", and the output
+// format, "json" or "text".
+func Configure(level, format string) error {
+	switch level {
+	case "info", "error":
+	default:
+		return fmt.Errorf("unknown log level %q", level)
+	}
+	switch format {
+	case "json", "text":
+	default:
+		return fmt.Errorf("unknown log format %q", format)
+	}
+	errorsOnly = level == "error"
+	textFormat = format == "text"
+	return nil
+}
 
 func WithRequestID(ctx context.Context) context.Context {
 	return context.WithValue(ctx, requestIDKey, uuid.New().String())
@@ -47,7 +76,12 @@ func GetRequestID(ctx context.Context) string {
 	return ""
 }
 
-
+// Flush commits what was logged to the underlying files, e.g. before the
+// process exits.
+func Flush() {
+	os.Stdout.Sync()
+	os.Stderr.Sync()
+}
 
 func Info(ctx context.Context, msg string, fields map[string]string) {
 	writeLog(ctx, "INFO", msg, fields, infoLogger)
@@ -58,6 +92,9 @@ func Error(ctx context.Context, msg string, fields map[string]string) {
 }
 
 func writeLog(ctx context.Context, level, msg string, fields map[string]string, l *log.Logger) {
+	if errorsOnly && level == "INFO" {
+		return
+	}
 	entry := LogEntry{
 		Timestamp: time.Now().Format(time.RFC3339Nano),
 		Level:     level,
@@ -69,11 +106,44 @@ func writeLog(ctx context.Context, level, msg string, fields map[string]string,
 		entry.Method = fields["method"]
 		entry.Path = fields["path"]
 		entry.Target = fields["target"]
+		entry.Route = fields["route"]
+		entry.Backend = fields["backend"]
+		entry.Group = fields["group"]
 		entry.Duration = fields["duration"]
-		entry.Status= fields["status"]
+		entry.Status = fields["status"]
+		entry.State = fields["state"]
+		entry.Percent = fields["percent"]
+		entry.Event = fields["event"]
+		entry.Reason = fields["reason"]
+		entry.Error = fields["error"]
+		entry.Stack = fields["stack"]
+		entry.User = fields["user"]
+		entry.Params = fields["params"]
 
 	}
 
+	if textFormat {
+		l.Println(entry.text())
+		return
+	}
 	data, _ := json.Marshal(entry)
 	l.Println(string(data))
-}
\ No newline at end of file
+}
+
+// text renders the entry as a line of key=value pairs after the message.
+func (e LogEntry) text() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s %q", e.Timestamp, e.Level, e.Message)
+	for _, kv := range [][2]string{
+		{"request_id", e.RequestID}, {"method", e.Method}, {"path", e.Path},
+		{"target", e.Target}, {"route", e.Route}, {"backend", e.Backend}, {"group", e.Group},
+		{"duration", e.Duration}, {"status", e.Status}, {"state", e.State}, {"percent", e.Percent},
+		{"event", e.Event}, {"reason", e.Reason}, {"user", e.User}, {"params", e.Params},
+		{"error", e.Error}, {"stack", e.Stack},
+	} {
+		if kv[1] != "" {
+			fmt.Fprintf(&b, " %s=%q", kv[0], kv[1])
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,194 @@
+package core
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// MatchConfig narrows a route beyond its path prefix. All listed conditions
+// must hold; within a list (hosts, methods, CIDRs) any entry may match.
+type MatchConfig struct {
+	Hosts       []string     `json:"hosts,omitempty"` // "api.example.com" or "*.example.com"
+	Methods     []string     `json:"methods,omitempty"`
+	Headers     []ValueMatch `json:"headers,omitempty"`
+	Query       []ValueMatch `json:"query,omitempty"`
+	ClientCIDRs []string     `json:"client_cidrs,omitempty"`
+}
+
+// ValueMatch tests a header or query parameter. Exactly one of Equals, Regex
+// or Present must be set.
+type ValueMatch struct {
+	Name    string `json:"name"`
+	Equals  string `json:"equals,omitempty"`
+	Regex   string `json:"regex,omitempty"`
+	Present *bool  `json:"present,omitempty"`
+}
+
+// MatchRule is a compiled MatchConfig.
+type MatchRule struct {
+	Config  *MatchConfig
+	headers []valueMatcher
+	query   []valueMatcher
+	cidrs   []*net.IPNet
+}
+
+type valueMatcher struct {
+	name    string
+	equals  string
+	regex   *regexp.Regexp
+	present *bool
+}
+
+func NewMatchRule(cfg *MatchConfig) (*MatchRule, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	rule := &MatchRule{Config: cfg}
+	var err error
+	if rule.headers, err = compileValueMatches("header", cfg.Headers); err != nil {
+		return nil, err
+	}
+	if rule.query, err = compileValueMatches("query", cfg.Query); err != nil {
+		return nil, err
+	}
+	for _, c := range cfg.ClientCIDRs {
+		_, ipNet, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, fmt.Errorf("invalid client CIDR %q: %w", c, err)
+		}
+		rule.cidrs = append(rule.cidrs, ipNet)
+	}
+	return rule, nil
+}
+
+// check reports a condition that is missing or ambiguous.
+func (m ValueMatch) check() error {
+	set := 0
+	for _, ok := range []bool{m.Equals != "", m.Regex != "", m.Present != nil} {
+		if ok {
+			set++
+		}
+	}
+	if set != 1 {
+		return fmt.Errorf("needs exactly one of equals, regex or present")
+	}
+	return nil
+}
+
+func compileValueMatches(kind string, in []ValueMatch) ([]valueMatcher, error) {
+	out := make([]valueMatcher, 0, len(in))
+	for _, m := range in {
+		if m.Name == "" {
+			return nil, fmt.Errorf("%s match without a name", kind)
+		}
+		if err := m.check(); err != nil {
+			return nil, fmt.Errorf("%s %s: %w", kind, m.Name, err)
+		}
+		vm := valueMatcher{name: m.Name, equals: m.Equals, present: m.Present}
+		if m.Regex != "" {
+			re, err := regexp.Compile(m.Regex)
+			if err != nil {
+				return nil, fmt.Errorf("%s %s: invalid regex: %w", kind, m.Name, err)
+			}
+			vm.regex = re
+		}
+		out = append(out, vm)
+	}
+	return out, nil
+}
+
+// Matches reports whether req satisfies every condition of the rule. A nil
+// rule matches everything.
+func (r *MatchRule) Matches(req *http.Request) bool {
+	if r == nil {
+		return true
+	}
+	if len(r.Config.Hosts) > 0 && !matchHost(r.Config.Hosts, req.Host) {
+		return false
+	}
+	if len(r.Config.Methods) > 0 && !slices.ContainsFunc(r.Config.Methods, func(m string) bool {
+		return strings.EqualFold(m, req.Method)
+	}) {
+		return false
+	}
+	for _, h := range r.headers {
+		values, ok := req.Header[http.CanonicalHeaderKey(h.name)]
+		if !h.matches(values, ok) {
+			return false
+		}
+	}
+	if len(r.query) > 0 {
+		q := req.URL.Query()
+		for _, m := range r.query {
+			values, ok := q[m.name]
+			if !m.matches(values, ok) {
+				return false
+			}
+		}
+	}
+	if len(r.cidrs) > 0 && !r.matchClient(req.RemoteAddr) {
+		return false
+	}
+	return true
+}
+
+func (m valueMatcher) matches(values []string, present bool) bool {
+	if m.present != nil {
+		return present == *m.present
+	}
+	if !present {
+		return false
+	}
+	for _, v := range values {
+		if m.regex != nil && m.regex.MatchString(v) {
+			return true
+		}
+		if m.regex == nil && v == m.equals {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *MatchRule) matchClient(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, n := range r.cidrs {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchHost compares the request host (port stripped) against the patterns.
+// "*.example.com" matches any subdomain of example.com but not example.com.
+func matchHost(patterns []string, host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+	for _, p := range patterns {
+		p = strings.ToLower(p)
+		if suffix, ok := strings.CutPrefix(p, "*"); ok {
+			if strings.HasSuffix(host, suffix) && len(host) > len(suffix) {
+				return true
+			}
+			continue
+		}
+		if host == p {
+			return true
+		}
+	}
+	return false
+}
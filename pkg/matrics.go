@@ -1,186 +1,323 @@
-
 package core
 
 import (
-    "github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 var (
-    // ===== ROUTE-LEVEL METRICS =====
-    
-    // Request volume and patterns
-    RouteRequestsTotal = prometheus.NewCounterVec(
-        prometheus.CounterOpts{
-            Name: "lb_route_requests_total",
-            Help: "Total number of requests received per route and HTTP method",
-        },
-        []string{"route", "method", "status_code"},
-    )
-
-    // Request latency distribution
-    RouteRequestDuration = prometheus.NewHistogramVec(
-        prometheus.HistogramOpts{
-            Name:    "lb_route_request_duration_seconds",
-            Help:    "Request latency distribution per route",
-            Buckets: []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
-        },
-        []string{"route", "method"},
-    )
-
-    // Active concurrent requests per route
-    RouteActiveRequests = prometheus.NewGaugeVec(
-        prometheus.GaugeOpts{
-            Name: "lb_route_active_requests",
-            Help: "Current number of active requests being processed per route",
-        },
-        []string{"route"},
-    )
-
-    // Route error rates by type
-    RouteErrorsTotal = prometheus.NewCounterVec(
-        prometheus.CounterOpts{
-            Name: "lb_route_errors_total",
-            Help: "Total number of errors per route and error type",
-        },
-        []string{"route", "error_type"}, // error_type: backend_down, timeout, connection_refused, etc.
-    )
-
-    // Request size distribution
-    RouteRequestSize = prometheus.NewHistogramVec(
-        prometheus.HistogramOpts{
-            Name:    "lb_route_request_size_bytes",
-            Help:    "Size of HTTP requests per route",
-            Buckets: []float64{100, 1000, 10000, 100000, 1000000},
-        },
-        []string{"route"},
-    )
-
-    // Response size distribution
-    RouteResponseSize = prometheus.NewHistogramVec(
-        prometheus.HistogramOpts{
-            Name:    "lb_route_response_size_bytes",
-            Help:    "Size of HTTP responses per route",
-            Buckets: []float64{100, 1000, 10000, 100000, 1000000, 10000000},
-        },
-        []string{"route"},
-    )
-
-    // Load balancing strategy effectiveness
-    RouteStrategyChanges = prometheus.NewCounterVec(
-        prometheus.CounterOpts{
-            Name: "lb_route_strategy_changes_total",
-            Help: "Number of times load balancing strategy was changed per route",
-        },
-        []string{"route", "from_strategy", "to_strategy"},
-    )
-
-    // ===== BACKEND-LEVEL METRICS =====
-
-    // Backend health and availability
-    BackendHealthStatus = prometheus.NewGaugeVec(
-        prometheus.GaugeOpts{
-            Name: "lb_backend_health_status",
-            Help: "Backend health status (1 = healthy, 0 = unhealthy)",
-        },
-        []string{"route", "backend", "backend_host"},
-    )
-
-    // Backend request distribution
-    BackendRequestsTotal = prometheus.NewCounterVec(
-        prometheus.CounterOpts{
-            Name: "lb_backend_requests_total",
-            Help: "Total number of requests sent to each backend",
-        },
-        []string{"route", "backend", "backend_host", "status_code"},
-    )
-
-    // Backend response time performance
-    BackendRequestDuration = prometheus.NewHistogramVec(
-        prometheus.HistogramOpts{
-            Name:    "lb_backend_request_duration_seconds",
-            Help:    "Request latency distribution per backend",
-            Buckets: []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
-        },
-        []string{"route", "backend", "backend_host"},
-    )
-
-    // Backend active connections
-    BackendActiveConnections = prometheus.NewGaugeVec(
-        prometheus.GaugeOpts{
-            Name: "lb_backend_active_connections",
-            Help: "Current number of active connections to each backend",
-        },
-        []string{"route", "backend", "backend_host"},
-    )
-
-  
-
-    // Backend failure tracking
-    BackendFailuresTotal = prometheus.NewCounterVec(
-        prometheus.CounterOpts{
-            Name: "lb_backend_failures_total",
-            Help: "Total number of backend failures by failure type",
-        },
-        []string{"route", "backend", "backend_host", "failure_type"}, // timeout, connection_refused, 5xx, etc.
-    )
-
-    // Backend selection frequency (for strategy analysis)
-    BackendSelectionTotal = prometheus.NewCounterVec(
-        prometheus.CounterOpts{
-            Name: "lb_backend_selection_total",
-            Help: "Number of times each backend was selected by load balancing strategy",
-        },
-        []string{"route", "backend", "backend_host", "strategy"},
-    )
-
-    // Backend health check metrics
-    BackendHealthCheckDuration = prometheus.NewHistogramVec(
-        prometheus.HistogramOpts{
-            Name:    "lb_backend_health_check_duration_seconds",
-            Help:    "Duration of health checks per backend",
-            Buckets: []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1},
-        },
-        []string{"route", "backend", "backend_host"},
-    )
-
-    BackendHealthCheckFailures = prometheus.NewCounterVec(
-        prometheus.CounterOpts{
-            Name: "lb_backend_health_check_failures_total",
-            Help: "Total number of health check failures per backend",
-        },
-        []string{"route", "backend", "backend_host"},
-    )
-
-    // Backend load metrics
-    BackendLoadScore = prometheus.NewGaugeVec(
-        prometheus.GaugeOpts{
-            Name: "lb_backend_load_score",
-            Help: "Current load score of each backend (used by least-loaded strategy)",
-        },
-        []string{"route", "backend", "backend_host"},
-    )
+	// ===== ROUTE-LEVEL METRICS =====
+
+	// Request volume and patterns
+	RouteRequestsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "lb_route_requests_total",
+			Help: "Total number of requests received per route and HTTP method",
+		},
+		[]string{"route", "method", "status_code"},
+	)
+
+	// Request latency distribution
+	RouteRequestDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "lb_route_request_duration_seconds",
+			Help:    "Request latency distribution per route",
+			Buckets: []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+		},
+		[]string{"route", "method"},
+	)
+
+	// Active concurrent requests per route
+	RouteActiveRequests = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "lb_route_active_requests",
+			Help: "Current number of active requests being processed per route",
+		},
+		[]string{"route"},
+	)
+
+	// Route error rates by type
+	RouteErrorsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "lb_route_errors_total",
+			Help: "Total number of errors per route and error type",
+		},
+		[]string{"route", "error_type"}, // error_type: backend_down, timeout, connection_refused, etc.
+	)
+
+	// Request size distribution
+	RouteRequestSize = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "lb_route_request_size_bytes",
+			Help:    "Size of HTTP requests per route",
+			Buckets: []float64{100, 1000, 10000, 100000, 1000000},
+		},
+		[]string{"route"},
+	)
+
+	// Response size distribution
+	RouteResponseSize = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "lb_route_response_size_bytes",
+			Help:    "Size of HTTP responses per route",
+			Buckets: []float64{100, 1000, 10000, 100000, 1000000, 10000000},
+		},
+		[]string{"route"},
+	)
+
+	// Load balancing strategy effectiveness
+	RouteStrategyChanges = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "lb_route_strategy_changes_total",
+			Help: "Number of times load balancing strategy was changed per route",
+		},
+		[]string{"route", "from_strategy", "to_strategy"},
+	)
+
+	// Retries issued after a failed proxy attempt
+	RouteRetriesTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "lb_route_retries_total",
+			Help: "Total number of proxy retries per route and failure reason",
+		},
+		[]string{"route", "reason"}, // reason: connection_error, timeout, server_error
+	)
+
+	// Traffic split between backend groups (stable, canary, ...)
+	RouteGroupRequestsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "lb_route_group_requests_total",
+			Help: "Total number of requests sent to each backend group of a split route",
+		},
+		[]string{"route", "group"},
+	)
+
+	RouteGroupPercent = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "lb_route_group_percent",
+			Help: "Configured traffic percentage of each non-baseline backend group",
+		},
+		[]string{"route", "group"},
+	)
+
+	CanaryRollbacksTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "lb_canary_rollbacks_total",
+			Help: "Number of canary ramps rolled back because of the group's 5xx rate",
+		},
+		[]string{"route", "group"},
+	)
+
+	// Sticky sessions whose pinned backend could not be used
+	StickyRepinsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "lb_sticky_repins_total",
+			Help: "Number of sticky clients moved to another backend because their pinned one was unavailable",
+		},
+		[]string{"route"},
+	)
+
+	// Panics recovered in the proxy path
+	PanicsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "lb_panics_total",
+			Help: "Number of panics recovered while handling requests",
+		},
+		[]string{"route"},
+	)
+
+	// ===== BACKEND-LEVEL METRICS =====
+
+	// Backend health and availability
+	BackendHealthStatus = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "lb_backend_health_status",
+			Help: "Backend health status (1 = healthy, 0 = unhealthy)",
+		},
+		[]string{"route", "backend", "backend_host"},
+	)
+
+	// Backend request distribution
+	BackendRequestsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "lb_backend_requests_total",
+			Help: "Total number of requests sent to each backend",
+		},
+		[]string{"route", "backend", "backend_host", "status_code"},
+	)
+
+	// Backend response time performance
+	BackendRequestDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "lb_backend_request_duration_seconds",
+			Help:    "Request latency distribution per backend",
+			Buckets: []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+		},
+		[]string{"route", "backend", "backend_host"},
+	)
+
+	// Backend active connections
+	BackendActiveConnections = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "lb_backend_active_connections",
+			Help: "Current number of active connections to each backend",
+		},
+		[]string{"route", "backend", "backend_host"},
+	)
+
+	// Backend failure tracking
+	BackendFailuresTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "lb_backend_failures_total",
+			Help: "Total number of backend failures by failure type",
+		},
+		[]string{"route", "backend", "backend_host", "failure_type"}, // timeout, connection_refused, 5xx, etc.
+	)
+
+	// Backend selection frequency (for strategy analysis)
+	BackendSelectionTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "lb_backend_selection_total",
+			Help: "Number of times each backend was selected by load balancing strategy",
+		},
+		[]string{"route", "backend", "backend_host", "strategy"},
+	)
+
+	// Backend health check metrics
+	BackendHealthCheckDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "lb_backend_health_check_duration_seconds",
+			Help:    "Duration of health checks per backend",
+			Buckets: []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1},
+		},
+		[]string{"route", "backend", "backend_host"},
+	)
+
+	BackendHealthCheckFailures = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "lb_backend_health_check_failures_total",
+			Help: "Total number of health check failures per backend",
+		},
+		[]string{"route", "backend", "backend_host"},
+	)
+
+	// Backend load metrics
+	BackendLoadScore = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "lb_backend_load_score",
+			Help: "Current load score of each backend (used by least-loaded strategy)",
+		},
+		[]string{"route", "backend", "backend_host"},
+	)
+
+	// Recent backend latency (EWMA or peak-EWMA, per the route's latency config)
+	BackendLatencyEWMA = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "lb_backend_latency_ewma_seconds",
+			Help: "Time-decayed average response time of each backend",
+		},
+		[]string{"route", "backend", "backend_host"},
+	)
+
+	// Backends taken out of their pool by outlier detection
+	BackendOutlierEjectionsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "lb_backend_outlier_ejections_total",
+			Help: "Times each backend was ejected by outlier detection, by reason",
+		},
+		[]string{"route", "backend", "backend_host", "reason"},
+	)
+
+	// Share of its normal traffic a backend gets while slow start ramps it up
+	BackendSlowStartFactor = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "lb_backend_slow_start_factor",
+			Help: "Slow-start factor of each backend on routes with slow start (1 = full share)",
+		},
+		[]string{"route", "backend", "backend_host"},
+	)
+
+	// Passive circuit breaker state
+	BackendCircuitState = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "lb_backend_circuit_state",
+			Help: "Circuit breaker state of each backend (0 = closed, 1 = open, 2 = half-open)",
+		},
+		[]string{"route", "backend", "backend_host"},
+	)
+
+	// ===== CONFIG METRICS =====
+
+	ConfigReloadsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "lb_config_reloads_total",
+			Help: "Number of configuration reloads by result",
+		},
+		[]string{"status"}, // success, failure
+	)
+
+	ConfigLastReloadSuccessful = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "lb_config_last_reload_successful",
+			Help: "Whether the last configuration reload succeeded (1) or was rejected (0)",
+		},
+	)
+
+	ConfigLastReloadTimestamp = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "lb_config_last_reload_success_timestamp_seconds",
+			Help: "Unix time of the last successful configuration reload",
+		},
+	)
+
+	// ===== WEBHOOK METRICS =====
+
+	WebhookDeliveriesTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "lb_webhook_deliveries_total",
+			Help: "Webhook events by endpoint, event type and outcome",
+		},
+		[]string{"webhook", "event", "result"}, // delivered, failed, dropped
+	)
 )
 
 func InitMetrics() {
-    prometheus.MustRegister(
-        // Route-level metrics
-        RouteRequestsTotal,
-        RouteRequestDuration,
-        RouteActiveRequests,
-        RouteErrorsTotal,
-        RouteRequestSize,
-        RouteResponseSize,
-        RouteStrategyChanges,
-        
-        // Backend-level metrics
-        BackendHealthStatus,
-        BackendRequestsTotal,
-        BackendRequestDuration,
-        BackendActiveConnections,
-        BackendFailuresTotal,
-        BackendSelectionTotal,
-        BackendHealthCheckDuration,
-        BackendHealthCheckFailures,
-        BackendLoadScore,
-    )
-}
\ No newline at end of file
+	prometheus.MustRegister(
+		// Route-level metrics
+		RouteRequestsTotal,
+		RouteRequestDuration,
+		RouteActiveRequests,
+		RouteErrorsTotal,
+		RouteRequestSize,
+		RouteResponseSize,
+		RouteStrategyChanges,
+		RouteRetriesTotal,
+		RouteGroupRequestsTotal,
+		RouteGroupPercent,
+		CanaryRollbacksTotal,
+		StickyRepinsTotal,
+		PanicsTotal,
+
+		// Backend-level metrics
+		BackendHealthStatus,
+		BackendRequestsTotal,
+		BackendRequestDuration,
+		BackendActiveConnections,
+		BackendFailuresTotal,
+		BackendSelectionTotal,
+		BackendHealthCheckDuration,
+		BackendHealthCheckFailures,
+		BackendLoadScore,
+		BackendLatencyEWMA,
+		BackendSlowStartFactor,
+		BackendOutlierEjectionsTotal,
+		BackendCircuitState,
+
+		// Config metrics
+		ConfigReloadsTotal,
+		ConfigLastReloadSuccessful,
+		ConfigLastReloadTimestamp,
+
+		// Webhook metrics
+		WebhookDeliveriesTotal,
+	)
+}
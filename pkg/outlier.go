@@ -0,0 +1,263 @@
+package core
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// OutlierDetectionConfig ejects backends from a route's pool based on live
+// traffic, as Envoy does. Unlike the circuit breaker, which judges each
+// backend on its own, ejection is capped per pool and success rates are
+// compared between the backends.
+type OutlierDetectionConfig struct {
+	Consecutive5xx            int      `json:"consecutive_5xx,omitempty"`             // 5xx responses or transport errors in a row; 0 disables
+	ConsecutiveGatewayFailure int      `json:"consecutive_gateway_failure,omitempty"` // 502, 503, 504 or transport errors in a row; 0 disables
+	SuccessRateStdevFactor    float64  `json:"success_rate_stdev_factor,omitempty"`   // eject below mean - factor × stdev, e.g. 1.9; 0 disables
+	SuccessRateMinHosts       int      `json:"success_rate_min_hosts,omitempty"`      // backends with enough requests for the comparison, default 5
+	SuccessRateRequestVolume  int      `json:"success_rate_request_volume,omitempty"` // requests per interval for a backend to take part, default 100
+	Interval                  Duration `json:"interval,omitempty"`                    // success rate analysis period, default 10s
+	BaseEjectionTime          Duration `json:"base_ejection_time,omitempty"`          // default 30s, doubled on every repeated ejection
+	MaxEjectionTime           Duration `json:"max_ejection_time,omitempty"`           // default 300s
+	MaxEjectionPercent        int      `json:"max_ejection_percent,omitempty"`        // default 10; one backend of a pool with several can always be ejected
+}
+
+func (c *OutlierDetectionConfig) validate() error {
+	if c == nil {
+		return nil
+	}
+	if c.Consecutive5xx < 0 || c.ConsecutiveGatewayFailure < 0 || c.SuccessRateMinHosts < 0 || c.SuccessRateRequestVolume < 0 {
+		return fmt.Errorf("outlier detection thresholds must not be negative")
+	}
+	if c.SuccessRateStdevFactor < 0 {
+		return fmt.Errorf("outlier detection success_rate_stdev_factor must not be negative")
+	}
+	if c.Interval < 0 || c.BaseEjectionTime < 0 || c.MaxEjectionTime < 0 {
+		return fmt.Errorf("outlier detection durations must not be negative")
+	}
+	if c.MaxEjectionPercent < 0 || c.MaxEjectionPercent > 100 {
+		return fmt.Errorf("outlier detection max_ejection_percent must be between 0 and 100")
+	}
+	return nil
+}
+
+func (c *OutlierDetectionConfig) interval() time.Duration {
+	if c.Interval > 0 {
+		return time.Duration(c.Interval)
+	}
+	return 10 * time.Second
+}
+
+func (c *OutlierDetectionConfig) minHosts() int {
+	if c.SuccessRateMinHosts > 0 {
+		return c.SuccessRateMinHosts
+	}
+	return 5
+}
+
+func (c *OutlierDetectionConfig) requestVolume() int {
+	if c.SuccessRateRequestVolume > 0 {
+		return c.SuccessRateRequestVolume
+	}
+	return 100
+}
+
+// ejectionTime is the base ejection time doubled for every earlier ejection
+// that has not decayed yet, up to the maximum.
+func (c *OutlierDetectionConfig) ejectionTime(ejections int) time.Duration {
+	base, limit := 30*time.Second, 300*time.Second
+	if c.BaseEjectionTime > 0 {
+		base = time.Duration(c.BaseEjectionTime)
+	}
+	if c.MaxEjectionTime > 0 {
+		limit = time.Duration(c.MaxEjectionTime)
+	}
+	d := base
+	for range ejections {
+		if d >= limit/2 {
+			return limit
+		}
+		d *= 2
+	}
+	return min(d, limit)
+}
+
+func (c *OutlierDetectionConfig) maxEjectionPercent() int {
+	if c.MaxEjectionPercent > 0 {
+		return c.MaxEjectionPercent
+	}
+	return 10
+}
+
+// outlierState holds the outlier detection counters of one backend.
+type outlierState struct {
+	mu                 sync.Mutex
+	consecutive5xx     int
+	consecutiveGateway int
+	requests           int // in the current interval
+	successes          int
+	ejectedUntil       time.Time
+	ejections          int // earlier ejections, decays by one every interval the backend stays in
+}
+
+func (s *outlierState) ejected(now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return now.Before(s.ejectedUntil)
+}
+
+// EjectedUntil returns when the current ejection of b ends, or the zero time.
+func (b *Backend) EjectedUntil() time.Time {
+	b.outlier.mu.Lock()
+	defer b.outlier.mu.Unlock()
+	if time.Now().Before(b.outlier.ejectedUntil) {
+		return b.outlier.ejectedUntil
+	}
+	return time.Time{}
+}
+
+// ejection is a backend taken out of its pool by outlier detection.
+type ejection struct {
+	backend  *Backend
+	reason   string // consecutive_5xx, consecutive_gateway_failure or success_rate
+	duration time.Duration
+}
+
+// recordOutlier feeds the outcome of a proxied request into outlier
+// detection and returns the ejection it caused, if any.
+func (BP *BackendPool) recordOutlier(b *Backend, status int, transportErr bool) *ejection {
+	cfg := BP.Outlier
+	if cfg == nil {
+		return nil
+	}
+	failed := transportErr || status >= 500
+	gateway := transportErr || status == http.StatusBadGateway ||
+		status == http.StatusServiceUnavailable || status == http.StatusGatewayTimeout
+
+	s := &b.outlier
+	s.mu.Lock()
+	s.requests++
+	if failed {
+		s.consecutive5xx++
+	} else {
+		s.successes++
+		s.consecutive5xx = 0
+	}
+	if gateway {
+		s.consecutiveGateway++
+	} else {
+		s.consecutiveGateway = 0
+	}
+	var reason string
+	switch {
+	case cfg.Consecutive5xx > 0 && s.consecutive5xx >= cfg.Consecutive5xx:
+		reason = "consecutive_5xx"
+	case cfg.ConsecutiveGatewayFailure > 0 && s.consecutiveGateway >= cfg.ConsecutiveGatewayFailure:
+		reason = "consecutive_gateway_failure"
+	}
+	s.mu.Unlock()
+
+	if reason == "" {
+		return nil
+	}
+	return BP.eject(b, reason, time.Now())
+}
+
+// sweepOutliers runs at most once per interval, from whichever request gets
+// there first. It ejects backends whose success rate is an outlier among
+// their peers, lets the ejection count of backends in service decay and
+// starts a new counting interval.
+func (BP *BackendPool) sweepOutliers(now time.Time) []*ejection {
+	cfg := BP.Outlier
+	if cfg == nil {
+		return nil
+	}
+	last := atomic.LoadInt64(&BP.outlierSweep)
+	if last == 0 {
+		atomic.CompareAndSwapInt64(&BP.outlierSweep, 0, now.UnixNano())
+		return nil
+	}
+	if now.Sub(time.Unix(0, last)) < cfg.interval() || !atomic.CompareAndSwapInt64(&BP.outlierSweep, last, now.UnixNano()) {
+		return nil
+	}
+
+	type sample struct {
+		b    *Backend
+		rate float64
+	}
+	var samples []sample
+	for _, b := range BP.Backends {
+		s := &b.outlier
+		s.mu.Lock()
+		if !now.Before(s.ejectedUntil) {
+			if s.ejections > 0 && now.Sub(s.ejectedUntil) >= cfg.interval() {
+				s.ejections--
+			}
+			if s.requests >= cfg.requestVolume() {
+				samples = append(samples, sample{b, float64(s.successes) / float64(s.requests)})
+			}
+		}
+		s.requests, s.successes = 0, 0
+		s.mu.Unlock()
+	}
+	if cfg.SuccessRateStdevFactor <= 0 || len(samples) < cfg.minHosts() {
+		return nil
+	}
+
+	var sum, squares float64
+	for _, s := range samples {
+		sum += s.rate
+	}
+	mean := sum / float64(len(samples))
+	for _, s := range samples {
+		squares += (s.rate - mean) * (s.rate - mean)
+	}
+	threshold := mean - cfg.SuccessRateStdevFactor*math.Sqrt(squares/float64(len(samples)))
+
+	var ejected []*ejection
+	for _, s := range samples {
+		if s.rate < threshold {
+			if e := BP.eject(s.b, "success_rate", now); e != nil {
+				ejected = append(ejected, e)
+			}
+		}
+	}
+	return ejected
+}
+
+// eject takes b out of the pool unless it is out already or the pool has
+// reached its cap of ejected backends.
+func (BP *BackendPool) eject(b *Backend, reason string, now time.Time) *ejection {
+	cfg := BP.Outlier
+	BP.mu.Lock()
+	defer BP.mu.Unlock()
+
+	if b.outlier.ejected(now) {
+		return nil
+	}
+	out := 0
+	for _, other := range BP.Backends {
+		if other.outlier.ejected(now) {
+			out++
+		}
+	}
+	limit := len(BP.Backends) * cfg.maxEjectionPercent() / 100
+	if limit == 0 && len(BP.Backends) > 1 {
+		limit = 1
+	}
+	if out >= limit {
+		return nil
+	}
+
+	s := &b.outlier
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d := cfg.ejectionTime(s.ejections)
+	s.ejectedUntil = now.Add(d)
+	s.ejections++
+	s.consecutive5xx, s.consecutiveGateway = 0, 0
+	return &ejection{backend: b, reason: reason, duration: d}
+}
@@ -0,0 +1,287 @@
+package core
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"go.yaml.in/yaml/v3"
+)
+
+// EnablePersistence makes Persist write the effective configuration to path.
+// path may be the config file itself or a separate state file; see
+// StartupConfigPath for how a state file is picked up again.
+func (lb *LoadBalancer) EnablePersistence(path string) {
+	lb.persistMu.Lock()
+	defer lb.persistMu.Unlock()
+	lb.persistPath = path
+}
+
+// ConfigVersion returns the version of the running configuration. It grows
+// by one with every admin change and every reload not read from the
+// persistence target.
+func (lb *LoadBalancer) ConfigVersion() int64 {
+	return atomic.LoadInt64(&lb.version)
+}
+
+// Config returns the effective configuration: what was loaded, plus changes
+// made through the admin API since.
+func (lb *LoadBalancer) Config() *Config {
+	lb.mux.RLock()
+	defer lb.mux.RUnlock()
+	cfg := &Config{
+		Version: atomic.LoadInt64(&lb.version),
+		Routes:  make([]RouteConfig, 0, len(lb.order)),
+	}
+	if lb.ErrorPages != nil {
+		cfg.ErrorPages = lb.ErrorPages.Config
+	}
+	for _, key := range lb.order {
+		cfg.Routes = append(cfg.Routes, lb.Routes[key].config)
+	}
+	return cfg
+}
+
+// PersistError reports a change that was applied but could not be recorded
+// in the history or written to the persistence target.
+type PersistError struct {
+	Err error
+}
+
+func (e *PersistError) Error() string { return e.Err.Error() }
+
+func (e *PersistError) Unwrap() error { return e.Err }
+
+// Change applies fn to the running configuration and records the result as
+// one step: it bumps the version, adds a snapshot to the history and, when
+// persistence is enabled, writes the effective config. Changes are applied
+// and recorded one at a time, so each version holds exactly one change and
+// its author. An error from fn is returned as is and nothing is recorded; a
+// change that is applied but not recorded fails with a *PersistError.
+// Nothing is recorded either if the config is the same as in the latest
+// snapshot.
+func (lb *LoadBalancer) Change(author, action string, fn func() error) (int64, error) {
+	return lb.change(author, action, true, fn)
+}
+
+func (lb *LoadBalancer) change(author, action string, write bool, fn func() error) (int64, error) {
+	lb.persistMu.Lock()
+	defer lb.persistMu.Unlock()
+	if err := fn(); err != nil {
+		return 0, err
+	}
+	version, err := lb.commit(author, action, write)
+	if err != nil {
+		return version, &PersistError{Err: err}
+	}
+	return version, nil
+}
+
+// commit records the running configuration. Callers hold persistMu.
+func (lb *LoadBalancer) commit(author, action string, write bool) (int64, error) {
+	cfg := lb.Config()
+	var prev *Config
+	if s := lb.history.latest(); s != nil {
+		prev = s.Config
+	}
+	diff := diffConfig(prev, cfg)
+	if prev != nil && diff.Empty() {
+		return cfg.Version, nil
+	}
+	if author == "" {
+		author = "unknown"
+	}
+	version := atomic.AddInt64(&lb.version, 1)
+	cfg.Version = version
+	snapshot := &Snapshot{
+		Version: version,
+		Time:    time.Now().UTC(),
+		Author:  author,
+		Action:  action,
+		Diff:    diff,
+		Config:  cfg,
+	}
+	if prev != nil {
+		lb.webhooks.notify(WebhookEvent{Type: EventConfigChanged, Time: snapshot.Time, Config: newConfigChange(snapshot)})
+	}
+	if err := lb.history.add(snapshot); err != nil {
+		return version, fmt.Errorf("applied but history not saved: %w", err)
+	}
+	if !write || lb.persistPath == "" {
+		return version, nil
+	}
+	data, err := WriteConfig(lb.persistPath, cfg)
+	if err != nil {
+		return version, fmt.Errorf("applied but not persisted: %w", err)
+	}
+	lb.persisted = sha256.Sum256(data)
+	return version, nil
+}
+
+// persistedTo reports whether path is the persistence target and, if so,
+// the digest of what was last written there.
+func (lb *LoadBalancer) persistedTo(path string) (bool, [sha256.Size]byte) {
+	lb.persistMu.Lock()
+	defer lb.persistMu.Unlock()
+	return lb.persistPath == path, lb.persisted
+}
+
+// WriteConfig writes cfg to path atomically, in the format of its extension:
+// readers see either the old or the new file, never a partial one. It returns
+// the bytes written.
+func WriteConfig(path string, cfg *Config) ([]byte, error) {
+	data, err := encodeConfig(path, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return data, writeFileAtomic(path, data)
+}
+
+func encodeConfig(path string, cfg *Config) ([]byte, error) {
+	data, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	format := configFormat(path)
+	if format == "json" {
+		return append(data, '\n'), nil
+	}
+	// Go through the JSON form so YAML and TOML use the same field names.
+	var generic map[string]any
+	if err := json.Unmarshal(data, &generic); err != nil {
+		return nil, err
+	}
+	generic = wholeNumbers(generic).(map[string]any)
+	if format == "yaml" {
+		return yaml.Marshal(generic)
+	}
+	var buf bytes.Buffer
+	err = toml.NewEncoder(&buf).Encode(generic)
+	return buf.Bytes(), err
+}
+
+// wholeNumbers turns the float64s encoding/json decodes numbers into back
+// into integers where they are whole, so they are not written as 3.0.
+func wholeNumbers(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for k, e := range v {
+			v[k] = wholeNumbers(e)
+		}
+	case []any:
+		for i := range v {
+			v[i] = wholeNumbers(v[i])
+		}
+	case float64:
+		if v == math.Trunc(v) {
+			return int64(v)
+		}
+	}
+	return v
+}
+
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// StartupConfigPath picks the file to start from when admin changes are
+// persisted to a separate state file: the state file, unless it is missing or
+// the config file was edited after it was last written.
+func StartupConfigPath(configPath, statePath string) string {
+	if statePath == "" || statePath == configPath {
+		return configPath
+	}
+	state, err := os.Stat(statePath)
+	if err != nil {
+		return configPath
+	}
+	if base, err := os.Stat(configPath); err == nil && base.ModTime().After(state.ModTime()) {
+		return configPath
+	}
+	return statePath
+}
+
+// configEqual compares route configs by their JSON form, so that e.g. a
+// weight of 0 and of 1 count as the same.
+func configEqual(a, b RouteConfig) bool {
+	x, errX := json.Marshal(a)
+	y, errY := json.Marshal(b)
+	return errX == nil && errY == nil && string(x) == string(y)
+}
+
+// The methods below keep RouteConfig in step with admin changes. They copy
+// before writing because configs share slices with the Config they were
+// loaded from.
+
+func (r *RouteConfig) setBackendWeight(url string, weight int) {
+	r.Backends = slices.Clone(r.Backends)
+	for i := range r.Backends {
+		if r.Backends[i].URL == url {
+			r.Backends[i].Weight = weight
+		}
+	}
+	r.editGroups(func(g *GroupConfig) {
+		for i := range g.Backends {
+			if g.Backends[i].URL == url {
+				g.Backends[i].Weight = weight
+			}
+		}
+	})
+}
+
+func (r *RouteConfig) removeBackend(url string) {
+	isURL := func(c BackendConfig) bool { return c.URL == url }
+	r.Backends = slices.DeleteFunc(slices.Clone(r.Backends), isURL)
+	r.editGroups(func(g *GroupConfig) {
+		g.Backends = slices.DeleteFunc(g.Backends, isURL)
+	})
+}
+
+func (r *RouteConfig) setGroupPercent(name string, percent int) {
+	r.editGroups(func(g *GroupConfig) {
+		if g.Name == name {
+			g.Percent = percent
+		}
+	})
+}
+
+// editGroups applies fn to a copy of every traffic split group.
+func (r *RouteConfig) editGroups(fn func(*GroupConfig)) {
+	if r.TrafficSplit == nil {
+		return
+	}
+	split := *r.TrafficSplit
+	split.Groups = slices.Clone(split.Groups)
+	for i := range split.Groups {
+		split.Groups[i].Backends = slices.Clone(split.Groups[i].Backends)
+		fn(&split.Groups[i])
+	}
+	r.TrafficSplit = &split
+}
@@ -0,0 +1,208 @@
+package core
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"slices"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/shashankk204/load_balancer/pkg/logger"
+)
+
+// ReloadResult lists the route keys a config change touched.
+type ReloadResult struct {
+	Added     []string `json:"added"`
+	Removed   []string `json:"removed"`
+	Updated   []string `json:"updated"`
+	Unchanged []string `json:"unchanged"`
+}
+
+// VersionConflictError rejects a config built on a version that is no longer
+// the running one.
+type VersionConflictError struct {
+	Expected int64
+	Current  int64
+}
+
+func (e *VersionConflictError) Error() string {
+	return fmt.Sprintf("config version %d is not the current version %d", e.Expected, e.Current)
+}
+
+// ApplyConfig replaces the running routes with cfg in one step. Routes whose
+// configuration did not change are kept as they are (including changes made
+// through the admin API since), changed routes are rebuilt around their
+// existing backends, and routes missing from cfg are removed. If any route
+// is invalid nothing is changed.
+//
+// A non-zero expected version makes the change conditional: it fails with a
+// *VersionConflictError unless expected is the running version. Run it inside
+// Change so that no other change can be applied before the version moves on.
+func (lb *LoadBalancer) ApplyConfig(cfg *Config, expected int64) (*ReloadResult, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	global, err := NewErrorPages(cfg.ErrorPages)
+	if err != nil {
+		return nil, fmt.Errorf("error_pages: %w", err)
+	}
+
+	lb.mux.Lock()
+	defer lb.mux.Unlock()
+	if expected != 0 {
+		if current := atomic.LoadInt64(&lb.version); expected != current {
+			return nil, &VersionConflictError{Expected: expected, Current: current}
+		}
+	}
+
+	staged := &LoadBalancer{
+		Routes:       make(map[string]*BackendPool, len(cfg.Routes)),
+		Trie:         NewTrie(),
+		prefixRoutes: make(map[string][]string),
+	}
+	result := &ReloadResult{}
+	var commits []func()
+	for _, r := range cfg.Routes {
+		key := r.Key()
+		old := lb.Routes[key]
+		pool := old
+		if old == nil || !configEqual(old.config, r) {
+			var commit func()
+			if pool, commit, err = newPool(r, old); err != nil {
+				return nil, err
+			}
+			commits = append(commits, commit)
+		}
+		if err := staged.registerRoute(key, pool); err != nil {
+			return nil, err
+		}
+		switch {
+		case old == nil:
+			result.Added = append(result.Added, key)
+		case pool == old:
+			result.Unchanged = append(result.Unchanged, key)
+		default:
+			result.Updated = append(result.Updated, key)
+		}
+	}
+
+	for key, old := range lb.Routes {
+		pool, kept := staged.Routes[key]
+		if !kept {
+			result.Removed = append(result.Removed, key)
+		}
+		if pool == old {
+			continue
+		}
+		if old.Split != nil {
+			old.Split.StopCanaryRamp()
+		}
+		if kept && pool.Strategy != old.Strategy {
+			RouteStrategyChanges.WithLabelValues(key, string(old.Strategy), string(pool.Strategy)).Inc()
+		}
+	}
+	slices.Sort(result.Removed)
+	for _, commit := range commits {
+		commit()
+	}
+	lb.Routes = staged.Routes
+	lb.Trie = staged.Trie
+	lb.prefixRoutes = staged.prefixRoutes
+	lb.order = staged.order
+	lb.ErrorPages = global
+	if cfg.Version > atomic.LoadInt64(&lb.version) {
+		atomic.StoreInt64(&lb.version, cfg.Version)
+	}
+	return result, nil
+}
+
+// ReloadConfig loads path and applies it. A config that cannot be read or is
+// invalid is rejected and the running one stays in place.
+func (lb *LoadBalancer) ReloadConfig(path string) (*ReloadResult, error) {
+	ctx := logger.WithRequestID(context.Background())
+	start := time.Now()
+	cfg, err := LoadConfig(path)
+	var result *ReloadResult
+	var persistErr *PersistError
+	if err == nil {
+		// Keep a separate state file in step with the config it replaced; the
+		// persistence target itself is only recorded in the history.
+		target, _ := lb.persistedTo(path)
+		_, err = lb.change("reload", "reload "+path, !target, func() error {
+			result, err = lb.ApplyConfig(cfg, 0)
+			return err
+		})
+		if errors.As(err, &persistErr) {
+			logger.Error(ctx, "Failed to persist reloaded config", map[string]string{
+				"path":  path,
+				"error": err.Error(),
+			})
+			err = nil
+		}
+	}
+	if err != nil {
+		ConfigReloadsTotal.WithLabelValues("failure").Inc()
+		ConfigLastReloadSuccessful.Set(0)
+		logger.Error(ctx, "Config reload failed, keeping the running config", map[string]string{
+			"path":  path,
+			"error": err.Error(),
+		})
+		return nil, err
+	}
+
+	ConfigReloadsTotal.WithLabelValues("success").Inc()
+	ConfigLastReloadSuccessful.Set(1)
+	ConfigLastReloadTimestamp.SetToCurrentTime()
+	logger.Info(ctx, "Config reloaded", map[string]string{
+		"path":     path,
+		"duration": time.Since(start).String(),
+	})
+	log.Printf("Reloaded %s: added %v, removed %v, updated %v, %d unchanged",
+		path, result.Added, result.Removed, result.Updated, len(result.Unchanged))
+	return result, nil
+}
+
+// WatchConfig reloads path whenever its contents change, checking every
+// interval, and on SIGHUP. It returns when ctx is cancelled.
+func (lb *LoadBalancer) WatchConfig(ctx context.Context, path string, interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	last, _ := fileDigest(path)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+		case <-ticker.C:
+			sum, err := fileDigest(path)
+			if err != nil || sum == last {
+				continue // unchanged, or briefly missing while an editor replaces it
+			}
+			if target, written := lb.persistedTo(path); target && sum == written {
+				last = sum
+				continue // our own write of an admin change
+			}
+		}
+		last, _ = fileDigest(path)
+		lb.ReloadConfig(path)
+	}
+}
+
+func fileDigest(path string) ([sha256.Size]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return [sha256.Size]byte{}, err
+	}
+	return sha256.Sum256(data), nil
+}
@@ -0,0 +1,243 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"time"
+)
+
+const defaultRetryBodyBytes = 1 << 20 // 1 MiB
+
+// RetryPolicy controls how a route retries failed proxy attempts on
+// another backend of the same pool.
+type RetryPolicy struct {
+	MaxAttempts    int      `json:"max_attempts"`
+	RetryOn        []int    `json:"retry_on,omitempty"`        // status codes, defaults to 502, 503, 504
+	IdempotentOnly *bool    `json:"idempotent_only,omitempty"` // defaults to true
+	PerTryTimeout  Duration `json:"per_try_timeout,omitempty"`
+	BackoffBase    Duration `json:"backoff_base,omitempty"`
+	BackoffMax     Duration `json:"backoff_max,omitempty"`
+	MaxBodyBytes   int64    `json:"max_body_bytes,omitempty"` // bodies above this are streamed and never retried
+}
+
+func (p *RetryPolicy) maxAttempts() int {
+	if p == nil || p.MaxAttempts < 1 {
+		return 1
+	}
+	return p.MaxAttempts
+}
+
+// allowsMethod reports whether responses to method may be retried at all.
+// Requests that never reached a backend are retried regardless.
+func (p *RetryPolicy) allowsMethod(method string) bool {
+	if p.IdempotentOnly != nil && !*p.IdempotentOnly {
+		return true
+	}
+	return isIdempotent(method)
+}
+
+func (p *RetryPolicy) retryableStatus(code int) bool {
+	if p == nil {
+		return false
+	}
+	if len(p.RetryOn) == 0 {
+		return code == http.StatusBadGateway || code == http.StatusServiceUnavailable || code == http.StatusGatewayTimeout
+	}
+	return slices.Contains(p.RetryOn, code)
+}
+
+func (p *RetryPolicy) bodyLimit() int64 {
+	if p.MaxBodyBytes > 0 {
+		return p.MaxBodyBytes
+	}
+	return defaultRetryBodyBytes
+}
+
+// backoff returns the wait before the given retry (1 = first retry).
+func (p *RetryPolicy) backoff(retry int) time.Duration {
+	base := time.Duration(p.BackoffBase)
+	if base <= 0 {
+		return 0
+	}
+	d := base << min(retry-1, 16)
+	if limit := time.Duration(p.BackoffMax); limit > 0 && d > limit {
+		d = limit
+	}
+	return d
+}
+
+func isIdempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// bufferBody reads the request body into memory so it can be replayed on
+// another backend. It reports false when the body is larger than limit, in
+// which case the body is left streamable but the request must not be retried.
+func bufferBody(req *http.Request, limit int64) (bool, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return true, nil
+	}
+	if req.ContentLength > limit {
+		return false, nil
+	}
+	buf, err := io.ReadAll(io.LimitReader(req.Body, limit+1))
+	if err != nil {
+		return false, err
+	}
+	if int64(len(buf)) > limit {
+		req.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(buf), req.Body), req.Body}
+		return false, nil
+	}
+	req.Body = io.NopCloser(bytes.NewReader(buf))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(buf)), nil
+	}
+	return true, nil
+}
+
+type attemptStateKey struct{}
+
+// attemptState carries the transport error of a single proxy attempt from
+// the ReverseProxy ErrorHandler back to ServeHTTP.
+type attemptState struct {
+	err   error
+	route string
+	pages []*ErrorPages // route and global error pages
+}
+
+func proxyErrorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	status := statusForError(r, err)
+	st, ok := r.Context().Value(attemptStateKey{}).(*attemptState)
+	if !ok {
+		w.WriteHeader(status)
+		return
+	}
+	st.err = err
+	if status == statusClientClosedRequest {
+		w.WriteHeader(status) // nobody is listening
+		return
+	}
+	writeErrorPage(r.Context(), w, r, st.route, status, errorMessage(status), st.pages...)
+}
+
+// classifyProxyError maps a transport error to a failure_type label.
+func classifyProxyError(err error) string {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return "timeout"
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return "timeout"
+	}
+	return "connection_error"
+}
+
+// isDialError reports whether the request never reached the backend, which
+// makes it safe to retry even non-idempotent methods.
+func isDialError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// attemptWriter sits between the ReverseProxy and the client. When another
+// attempt is still possible it swallows a retryable response instead of
+// forwarding it, so nothing reaches the client until an attempt is final.
+type attemptWriter struct {
+	w           http.ResponseWriter
+	header      http.Header
+	state       *attemptState
+	policy      *RetryPolicy
+	method      string
+	canRetry    bool
+	wroteHeader bool
+	status      int
+	discarded   bool
+}
+
+func newAttemptWriter(w http.ResponseWriter, st *attemptState, policy *RetryPolicy, method string, canRetry bool) *attemptWriter {
+	return &attemptWriter{w: w, header: make(http.Header), state: st, policy: policy, method: method, canRetry: canRetry}
+}
+
+func (a *attemptWriter) Header() http.Header {
+	return a.header
+}
+
+func (a *attemptWriter) WriteHeader(statusCode int) {
+	if a.wroteHeader {
+		return
+	}
+	if informational(statusCode) {
+		// 100 Continue and 103 Early Hints go straight to the client; the
+		// final status that follows is the one the attempt is judged by.
+		dst := a.w.Header()
+		saved := dst.Clone()
+		for k, v := range a.header {
+			dst[k] = v
+		}
+		a.w.WriteHeader(statusCode)
+		clear(dst)
+		for k, v := range saved {
+			dst[k] = v
+		}
+		return
+	}
+	a.wroteHeader = true
+	a.status = statusCode
+	if a.canRetry && a.shouldRetry() {
+		a.discarded = true
+		return
+	}
+	dst := a.w.Header()
+	for k, v := range a.header {
+		dst[k] = v
+	}
+	a.w.WriteHeader(statusCode)
+}
+
+// informational reports whether code is a 1xx response that precedes the
+// final one. 101 Switching Protocols ends the exchange, so it is not.
+func informational(code int) bool {
+	return code >= 100 && code < 200 && code != http.StatusSwitchingProtocols
+}
+
+func (a *attemptWriter) Write(data []byte) (int, error) {
+	if !a.wroteHeader {
+		a.WriteHeader(http.StatusOK)
+	}
+	if a.discarded {
+		return len(data), nil
+	}
+	return a.w.Write(data)
+}
+
+func (a *attemptWriter) Flush() {
+	if a.discarded {
+		return
+	}
+	if f, ok := a.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// shouldRetry reports whether the attempt failed in a way the policy retries.
+func (a *attemptWriter) shouldRetry() bool {
+	if errors.Is(a.state.err, context.Canceled) {
+		return false // the client is gone
+	}
+	if a.state.err != nil {
+		return a.policy.allowsMethod(a.method) || isDialError(a.state.err)
+	}
+	return a.policy.allowsMethod(a.method) && a.policy.retryableStatus(a.status)
+}
@@ -0,0 +1,321 @@
+package core
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Settings are the process-wide options, as opposed to the routes config.
+// They come from, in increasing order of precedence: built-in defaults, a
+// settings file, LB_* environment variables and command-line flags.
+//
+// Every field is reachable all three ways under a name derived from its JSON
+// path: health.interval is "interval" under "health" in the file,
+// LB_HEALTH_INTERVAL in the environment and -health.interval on the command
+// line.
+type Settings struct {
+	Listen        string   `json:"listen" help:"address of the proxy listener"`
+	Config        string   `json:"config" help:"routes config file (.json, .yaml, .yml or .toml)"`
+	WatchInterval Duration `json:"watch_interval" help:"how often the routes config is checked for changes"`
+
+	ShutdownTimeout Duration `json:"shutdown_timeout" help:"how long in-flight requests may take to finish on SIGTERM or SIGINT"`
+
+	Admin struct {
+		Listen string `json:"listen" help:"address of the admin API listener"`
+		Config string `json:"config" help:"admin TLS and credentials file; the admin API is unauthenticated without it"`
+	} `json:"admin"`
+
+	Webhooks struct {
+		Config string `json:"config" help:"webhooks file of endpoints notified of backend, circuit, route and config changes; none if empty"`
+	} `json:"webhooks"`
+
+	Persist struct {
+		Path string `json:"path" help:"file admin changes are written to, none if empty"`
+	} `json:"persist"`
+
+	History struct {
+		Dir   string `json:"dir" help:"directory config versions are kept in, memory only if empty"`
+		Limit int    `json:"limit" help:"number of config versions kept"`
+	} `json:"history"`
+
+	Health HealthCheckConfig `json:"health"`
+
+	RateLimit struct {
+		Rate  int `json:"rate" help:"requests per second allowed per client, 0 to disable rate limiting"`
+		Burst int `json:"burst" help:"requests a client may send at once"`
+	} `json:"rate_limit"`
+
+	Log struct {
+		Level  string `json:"level" help:"minimum log level: info or error"`
+		Format string `json:"format" help:"log format: json or text"`
+	} `json:"log"`
+
+	Metrics struct {
+		Enabled bool   `json:"enabled" help:"serve Prometheus metrics"`
+		Path    string `json:"path" help:"path metrics are served on"`
+		Listen  string `json:"listen" help:"separate address for metrics, the proxy listener if empty"`
+	} `json:"metrics"`
+
+	sources map[string]string // setting name -> where its value came from
+}
+
+func DefaultSettings() *Settings {
+	s := &Settings{
+		Listen:          ":8080",
+		Config:          "routes.json",
+		WatchInterval:   Duration(2 * time.Second),
+		ShutdownTimeout: Duration(30 * time.Second),
+		Health: HealthCheckConfig{
+			Path:         "/health",
+			Method:       "GET",
+			ExpectStatus: "200",
+			Interval:     Duration(5 * time.Second),
+			Timeout:      Duration(2 * time.Second),
+			Rise:         1,
+			Fall:         1,
+		},
+	}
+	s.Admin.Listen = "127.0.0.1:8090"
+	s.History.Limit = defaultHistoryLimit
+	s.RateLimit.Rate = 5
+	s.RateLimit.Burst = 10
+	s.Log.Level = "info"
+	s.Log.Format = "json"
+	s.Metrics.Enabled = true
+	s.Metrics.Path = "/metrics"
+	return s
+}
+
+// LoadSettings builds the settings from the defaults, the settings file named
+// by -settings or LB_SETTINGS, the environment and args. It returns
+// flag.ErrHelp if args ask for usage, which has then been printed.
+func LoadSettings(args []string, getenv func(string) string) (*Settings, error) {
+	s := DefaultSettings()
+	fields := s.fields()
+
+	// Flags are parsed into a copy first: the file they may name has to be
+	// applied before them.
+	parsed := DefaultSettings()
+	fs := flag.NewFlagSet("load_balancer", flag.ContinueOnError)
+	settingsFile := fs.String("settings", getenv("LB_SETTINGS"), "settings file (.json, .yaml, .yml or .toml), also LB_SETTINGS")
+	for _, f := range parsed.fields() {
+		fs.Var(f, f.flagName(), f.help+", also "+f.envName())
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected argument %q", fs.Arg(0))
+	}
+
+	s.sources = make(map[string]string, len(fields))
+	if *settingsFile != "" {
+		before := make([]string, len(fields))
+		for i, f := range fields {
+			before[i] = f.String()
+		}
+		data, err := os.ReadFile(*settingsFile)
+		if err != nil {
+			return nil, err
+		}
+		if err := decodeStrict(data, configFormat(*settingsFile), s); err != nil {
+			var cfgErr *ConfigError
+			if errors.As(err, &cfgErr) {
+				cfgErr.File = *settingsFile
+				return nil, cfgErr
+			}
+			return nil, fmt.Errorf("%s: %w", *settingsFile, err)
+		}
+		for i, f := range fields {
+			if f.String() != before[i] {
+				s.sources[f.name] = *settingsFile
+			}
+		}
+	}
+	for _, f := range fields {
+		if v := getenv(f.envName()); v != "" {
+			if err := f.Set(v); err != nil {
+				return nil, fmt.Errorf("%s: %w", f.envName(), err)
+			}
+			s.sources[f.name] = "env " + f.envName()
+		}
+	}
+	byFlag := make(map[string]settingField, len(fields))
+	for _, f := range fields {
+		byFlag[f.flagName()] = f
+	}
+	fs.Visit(func(fl *flag.Flag) {
+		if f, ok := byFlag[fl.Name]; ok {
+			f.Set(fl.Value.String())
+			s.sources[f.name] = "flag -" + fl.Name
+		}
+	})
+
+	return s, s.validate()
+}
+
+func (s *Settings) validate() error {
+	var ps problems
+	switch s.Log.Level {
+	case "info", "error":
+	default:
+		ps.add("log.level", "must be info or error")
+	}
+	switch s.Log.Format {
+	case "json", "text":
+	default:
+		ps.add("log.format", "must be json or text")
+	}
+	if s.Listen == "" {
+		ps.add("listen", "is required")
+	}
+	if s.Config == "" {
+		ps.add("config", "is required")
+	}
+	if s.WatchInterval <= 0 {
+		ps.add("watch_interval", "must be positive")
+	}
+	if s.ShutdownTimeout < 0 {
+		ps.add("shutdown_timeout", "must not be negative")
+	}
+	if s.Health.Interval <= 0 {
+		ps.add("health.interval", "must be positive")
+	}
+	if s.Health.Timeout <= 0 {
+		ps.add("health.timeout", "must be positive")
+	}
+	if err := s.Health.validate(); err != nil {
+		ps.add("health", "%v", err)
+	}
+	if s.RateLimit.Rate < 0 || s.RateLimit.Burst < 0 {
+		ps.add("rate_limit", "rate and burst must not be negative")
+	}
+	if s.RateLimit.Rate > 0 && s.RateLimit.Burst == 0 {
+		ps.add("rate_limit.burst", "must be at least 1 when rate limiting is enabled")
+	}
+	if s.Metrics.Enabled && !strings.HasPrefix(s.Metrics.Path, "/") {
+		ps.add("metrics.path", "must start with /")
+	}
+	if len(ps) > 0 {
+		return &ConfigError{File: "settings", Problems: ps}
+	}
+	return nil
+}
+
+// Print writes the effective settings, one per line with where each value
+// came from.
+func (s *Settings) Print(w io.Writer) {
+	fmt.Fprintln(w, "Effective settings:")
+	for _, f := range s.fields() {
+		source := s.sources[f.name]
+		if source == "" {
+			source = "default"
+		}
+		fmt.Fprintf(w, "  %-22s = %-20q (%s)\n", f.name, f.String(), source)
+	}
+}
+
+// settingField is one leaf of Settings, usable as a flag.Value.
+type settingField struct {
+	name string // JSON path, e.g. "health.interval"
+	help string
+	v    reflect.Value
+}
+
+var (
+	durationType = reflect.TypeFor[Duration]()
+	boolPtrType  = reflect.TypeFor[*bool]()
+)
+
+func (s *Settings) fields() []settingField {
+	var out []settingField
+	var walk func(v reflect.Value, prefix string)
+	walk = func(v reflect.Value, prefix string) {
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if !f.IsExported() {
+				continue
+			}
+			name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+			name = prefix + name
+			switch f.Type.Kind() {
+			case reflect.Struct:
+				walk(v.Field(i), name+".")
+				continue
+			case reflect.Map:
+				continue // only in the settings file
+			}
+			out = append(out, settingField{name: name, help: f.Tag.Get("help"), v: v.Field(i)})
+		}
+	}
+	walk(reflect.ValueOf(s).Elem(), "")
+	return out
+}
+
+func (f settingField) flagName() string {
+	return strings.ReplaceAll(f.name, "_", "-")
+}
+
+func (f settingField) envName() string {
+	return "LB_" + strings.ToUpper(strings.NewReplacer(".", "_", "-", "_").Replace(f.name))
+}
+
+func (f settingField) String() string {
+	if !f.v.IsValid() {
+		return "" // the zero value the flag package makes for its usage text
+	}
+	if f.v.Type() == durationType {
+		return time.Duration(f.v.Int()).String()
+	}
+	if f.v.Type() == boolPtrType {
+		return strconv.FormatBool(!f.v.IsNil() && f.v.Elem().Bool())
+	}
+	return fmt.Sprint(f.v.Interface())
+}
+
+func (f settingField) Set(value string) error {
+	switch {
+	case f.v.Type() == durationType:
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		f.v.SetInt(int64(d))
+	case f.v.Kind() == reflect.String:
+		f.v.SetString(value)
+	case f.v.Kind() == reflect.Int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("%q is not a whole number", value)
+		}
+		f.v.SetInt(int64(n))
+	case f.v.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%q is not true or false", value)
+		}
+		f.v.SetBool(b)
+	case f.v.Type() == boolPtrType:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%q is not true or false", value)
+		}
+		f.v.Set(reflect.ValueOf(&b))
+	default:
+		return fmt.Errorf("unsupported setting type %s", f.v.Type())
+	}
+	return nil
+}
+
+// IsBoolFlag lets boolean settings be given as -metrics.enabled on their own.
+func (f settingField) IsBoolFlag() bool {
+	return f.v.IsValid() && (f.v.Kind() == reflect.Bool || f.v.Type() == boolPtrType)
+}
@@ -0,0 +1,94 @@
+package core
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultSlowStartPercent = 10
+	slowStartWeightScale    = 100 // weighted round robin units per unit of weight
+)
+
+// SlowStartConfig ramps up the traffic of a backend that was added to a
+// running route or passed a health check again, so that it is not flooded
+// while cold: least_active and least_latency would otherwise prefer it for
+// having no requests and no latency samples.
+type SlowStartConfig struct {
+	Window       Duration `json:"window"`                  // time until the backend gets its full share
+	StartPercent int      `json:"start_percent,omitempty"` // share of its normal traffic at first, default 10
+}
+
+func (c *SlowStartConfig) validate() error {
+	if c == nil {
+		return nil
+	}
+	if c.Window <= 0 {
+		return fmt.Errorf("slow_start window must be positive")
+	}
+	if c.StartPercent < 0 || c.StartPercent > 100 {
+		return fmt.Errorf("slow_start start_percent must be between 0 and 100, where 0 means the default of %d", defaultSlowStartPercent)
+	}
+	return nil
+}
+
+func (c *SlowStartConfig) start() float64 {
+	if c.StartPercent == 0 {
+		return defaultSlowStartPercent / 100.0
+	}
+	return float64(c.StartPercent) / 100
+}
+
+// startSlowStart (re)starts the ramp of b. It only takes effect on routes
+// with a slow_start config.
+func (b *Backend) startSlowStart() {
+	atomic.StoreInt64(&b.warmingSince, time.Now().UnixNano())
+}
+
+// SlowStartFactor returns the share of its normal traffic b gets: the
+// start percentage right after the ramp began, rising linearly to 1 at the
+// end of the window.
+func (b *Backend) SlowStartFactor(cfg *SlowStartConfig) float64 {
+	since := atomic.LoadInt64(&b.warmingSince)
+	if since == 0 || cfg == nil {
+		return 1
+	}
+	elapsed := time.Since(time.Unix(0, since))
+	if elapsed >= time.Duration(cfg.Window) {
+		atomic.CompareAndSwapInt64(&b.warmingSince, since, 0)
+		return 1
+	}
+	start := cfg.start()
+	return start + (1-start)*float64(elapsed)/float64(cfg.Window)
+}
+
+// holdBack draws the warming backends that sit out one pick: each takes part
+// only with the probability of its slow-start factor.
+func (BP *BackendPool) holdBack() map[*Backend]bool {
+	if BP.SlowStart == nil {
+		return nil
+	}
+	var held map[*Backend]bool
+	for _, b := range BP.Backends {
+		if factor := b.SlowStartFactor(BP.SlowStart); factor < 1 && rand.Float64() >= factor {
+			if held == nil {
+				held = make(map[*Backend]bool)
+			}
+			held[b] = true
+		}
+	}
+	return held
+}
+
+// wrrWeight is b's weight in the smooth weighted round robin. With slow start
+// all weights are scaled up so that a warming backend's can be cut to its
+// factor without rounding it away.
+func (BP *BackendPool) wrrWeight(b *Backend) int64 {
+	w := int64(b.GetWeight())
+	if BP.SlowStart == nil {
+		return w
+	}
+	return max(1, int64(float64(w*slowStartWeightScale)*b.SlowStartFactor(BP.SlowStart)))
+}
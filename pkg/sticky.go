@@ -0,0 +1,208 @@
+package core
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	StickyCookie    = "cookie"     // the balancer sets a signed cookie naming the backend
+	StickyAppCookie = "app_cookie" // the balancer follows a session cookie set by the application
+
+	defaultStickyCookie = "lb_sticky"
+	defaultAppStickyTTL = time.Hour
+)
+
+// StickyConfig pins clients of a route to one backend.
+type StickyConfig struct {
+	Mode       string   `json:"mode,omitempty"`        // "cookie" (default) or "app_cookie"
+	CookieName string   `json:"cookie_name,omitempty"` // our cookie, or the application's session cookie in app_cookie mode
+	TTL        Duration `json:"ttl,omitempty"`         // cookie lifetime; 0 means a browser-session cookie
+	Secret     string   `json:"secret,omitempty"`      // HMAC key; random per process when empty
+	Secure     bool     `json:"secure,omitempty"`
+}
+
+// StickySessions is the runtime state of a sticky route.
+type StickySessions struct {
+	Config *StickyConfig
+	key    []byte
+
+	mu      sync.Mutex
+	table   map[string]stickyEntry // app_cookie mode: session value -> backend
+	inserts int
+}
+
+type stickyEntry struct {
+	backendID string
+	expires   time.Time
+}
+
+func NewStickySessions(cfg *StickyConfig) (*StickySessions, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	switch cfg.Mode {
+	case "", StickyCookie, StickyAppCookie:
+	default:
+		return nil, fmt.Errorf("unknown sticky mode %q", cfg.Mode)
+	}
+	if cfg.Mode == StickyAppCookie && cfg.CookieName == "" {
+		return nil, fmt.Errorf("sticky app_cookie mode needs the application's cookie_name")
+	}
+	s := &StickySessions{Config: cfg, table: make(map[string]stickyEntry)}
+	if cfg.Secret != "" {
+		s.key = []byte(cfg.Secret)
+	} else {
+		s.key = make([]byte, 32)
+		if _, err := rand.Read(s.key); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (s *StickySessions) appMode() bool {
+	return s.Config.Mode == StickyAppCookie
+}
+
+func (s *StickySessions) cookieName() string {
+	if s.Config.CookieName != "" {
+		return s.Config.CookieName
+	}
+	return defaultStickyCookie
+}
+
+// backendID identifies a backend in a pin: its URL in app_cookie mode (the
+// table is server-side), an opaque digest in our own cookie so internal
+// addresses are not handed to clients.
+func (s *StickySessions) backendID(b *Backend) string {
+	if s.appMode() {
+		return b.URL.String()
+	}
+	sum := sha256.Sum256([]byte(b.URL.String()))
+	return base64.RawURLEncoding.EncodeToString(sum[:12])
+}
+
+// pinnedID returns the backend ID the request is pinned to, if any.
+func (s *StickySessions) pinnedID(req *http.Request) string {
+	cookie, err := req.Cookie(s.cookieName())
+	if err != nil || cookie.Value == "" {
+		return ""
+	}
+	if s.appMode() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		entry, ok := s.table[cookie.Value]
+		if !ok || time.Now().After(entry.expires) {
+			delete(s.table, cookie.Value)
+			return ""
+		}
+		return entry.backendID
+	}
+	id, ok := s.verify(cookie.Value)
+	if !ok {
+		return ""
+	}
+	return id
+}
+
+// Pinned returns the backend of pool the request is pinned to. The second
+// result is true when the request carried a valid pin, even if its backend
+// is no longer in the pool.
+func (s *StickySessions) Pinned(req *http.Request, pool *BackendPool) (*Backend, bool) {
+	id := s.pinnedID(req)
+	if id == "" {
+		return nil, false
+	}
+	for _, b := range pool.Backends {
+		if s.backendID(b) == id {
+			return b, true
+		}
+	}
+	return nil, true
+}
+
+// Apply updates the response headers once the serving backend is known. In
+// cookie mode it (re)issues the signed cookie when the client is not already
+// pinned to target; in app_cookie mode it learns session cookies set by the
+// application and moves existing sessions that had to be re-pinned.
+func (s *StickySessions) Apply(h http.Header, req *http.Request, target *Backend) {
+	id := s.backendID(target)
+	if !s.appMode() {
+		if s.pinnedID(req) == id {
+			return
+		}
+		cookie := &http.Cookie{
+			Name:     s.cookieName(),
+			Value:    s.sign(id),
+			Path:     "/",
+			HttpOnly: true,
+			Secure:   s.Config.Secure,
+			SameSite: http.SameSiteLaxMode,
+		}
+		if s.Config.TTL > 0 {
+			cookie.MaxAge = int(time.Duration(s.Config.TTL).Seconds())
+		}
+		h.Add("Set-Cookie", cookie.String())
+		return
+	}
+
+	if cookie, err := req.Cookie(s.cookieName()); err == nil && cookie.Value != "" {
+		s.remember(cookie.Value, id)
+	}
+	for _, c := range (&http.Response{Header: h}).Cookies() {
+		if c.Name == s.cookieName() && c.Value != "" {
+			s.remember(c.Value, id)
+		}
+	}
+}
+
+func (s *StickySessions) remember(value, backendID string) {
+	ttl := time.Duration(s.Config.TTL)
+	if ttl <= 0 {
+		ttl = defaultAppStickyTTL
+	}
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.table[value] = stickyEntry{backendID: backendID, expires: now.Add(ttl)}
+	s.inserts++
+	if s.inserts%1024 == 0 {
+		for k, e := range s.table {
+			if now.After(e.expires) {
+				delete(s.table, k)
+			}
+		}
+	}
+}
+
+// sign encodes a backend ID as "<id>.<base64 hmac>".
+func (s *StickySessions) sign(id string) string {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(id))
+	return id + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (s *StickySessions) verify(value string) (string, bool) {
+	id, encSig, ok := strings.Cut(value, ".")
+	if !ok {
+		return "", false
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(encSig)
+	if err != nil {
+		return "", false
+	}
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(id))
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return "", false
+	}
+	return id, true
+}
@@ -0,0 +1,157 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultConnectTimeout        = 5 * time.Second
+	defaultResponseHeaderTimeout = 30 * time.Second
+	defaultKeepAlive             = 30 * time.Second
+	defaultIdleConnTimeout       = 90 * time.Second
+	defaultMaxIdleConnsPerHost   = 32
+
+	// statusClientClosedRequest is recorded when the client goes away before
+	// the backend answered (nginx uses the same code).
+	statusClientClosedRequest = 499
+)
+
+// TimeoutConfig bounds a proxied request. On a route, Total covers the whole
+// request including retries; on a backend it covers each attempt sent to that
+// backend. Backend values override the route's Connect and ResponseHeader.
+type TimeoutConfig struct {
+	Connect        Duration `json:"connect,omitempty"`         // TCP connect, default 5s
+	ResponseHeader Duration `json:"response_header,omitempty"` // wait for the response headers after sending the request, default 30s
+	Total          Duration `json:"total,omitempty"`           // 0 means no limit
+}
+
+// merge returns the timeouts of a backend: the route's connect and
+// response-header values overridden by the backend's own, plus the backend's
+// per-attempt total.
+func (t *TimeoutConfig) merge(backend *TimeoutConfig) TimeoutConfig {
+	var out TimeoutConfig
+	if t != nil {
+		out.Connect = t.Connect
+		out.ResponseHeader = t.ResponseHeader
+	}
+	if backend != nil {
+		if backend.Connect > 0 {
+			out.Connect = backend.Connect
+		}
+		if backend.ResponseHeader > 0 {
+			out.ResponseHeader = backend.ResponseHeader
+		}
+		out.Total = backend.Total
+	}
+	return out
+}
+
+func (t *TimeoutConfig) total() time.Duration {
+	if t == nil {
+		return 0
+	}
+	return time.Duration(t.Total)
+}
+
+// TransportConfig tunes the connection pool towards the backends of a route.
+type TransportConfig struct {
+	MaxIdleConns        int      `json:"max_idle_conns,omitempty"`          // across all backends of the route, 0 = unlimited
+	MaxIdleConnsPerHost int      `json:"max_idle_conns_per_host,omitempty"` // default 32
+	MaxConnsPerHost     int      `json:"max_conns_per_host,omitempty"`      // 0 = unlimited
+	IdleConnTimeout     Duration `json:"idle_conn_timeout,omitempty"`       // default 90s
+	KeepAlive           Duration `json:"keep_alive,omitempty"`              // TCP keep-alive probe interval, default 30s
+	DisableKeepAlives   bool     `json:"disable_keep_alives,omitempty"`
+}
+
+func newTransport(timeouts TimeoutConfig, cfg *TransportConfig) *http.Transport {
+	if cfg == nil {
+		cfg = &TransportConfig{}
+	}
+	dialer := &net.Dialer{
+		Timeout:   durationOr(timeouts.Connect, defaultConnectTimeout),
+		KeepAlive: durationOr(cfg.KeepAlive, defaultKeepAlive),
+	}
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.DialContext = dialer.DialContext
+	tr.ResponseHeaderTimeout = durationOr(timeouts.ResponseHeader, defaultResponseHeaderTimeout)
+	tr.MaxIdleConns = cfg.MaxIdleConns
+	tr.MaxIdleConnsPerHost = defaultMaxIdleConnsPerHost
+	if cfg.MaxIdleConnsPerHost > 0 {
+		tr.MaxIdleConnsPerHost = cfg.MaxIdleConnsPerHost
+	}
+	tr.MaxConnsPerHost = cfg.MaxConnsPerHost
+	tr.IdleConnTimeout = durationOr(cfg.IdleConnTimeout, defaultIdleConnTimeout)
+	tr.DisableKeepAlives = cfg.DisableKeepAlives
+	return tr
+}
+
+func durationOr(d Duration, def time.Duration) time.Duration {
+	if d > 0 {
+		return time.Duration(d)
+	}
+	return def
+}
+
+// newBackend creates a backend with the pool's timeouts and transport
+// settings applied.
+func (BP *BackendPool) newBackend(c BackendConfig) (*Backend, error) {
+	b, err := NewBackend(c.URL)
+	if err != nil {
+		return nil, err
+	}
+	BP.configureBackend(b, c)
+	return b, nil
+}
+
+// configureBackend applies c to b, replacing its transport when the timeouts
+// or transport settings changed. Requests already using the old transport
+// finish on it. Callers must hold lb.mux or own b.
+func (BP *BackendPool) configureBackend(b *Backend, c BackendConfig) {
+	b.SetWeight(c.Weight)
+	timeouts := BP.Timeouts.merge(c.Timeouts)
+	var transport TransportConfig
+	if BP.Transport != nil {
+		transport = *BP.Transport
+	}
+	if timeouts == b.Timeouts() && transport == b.transport {
+		return
+	}
+	b.transport = transport
+	b.timeouts.Store(&timeouts)
+	old := b.roundTripper.current.Swap(newTransport(timeouts, BP.Transport))
+	old.CloseIdleConnections()
+}
+
+// swappableTransport passes requests on to a transport that can be replaced
+// while requests are in flight.
+type swappableTransport struct {
+	current atomic.Pointer[http.Transport]
+}
+
+func (t *swappableTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return t.current.Load().RoundTrip(req)
+}
+
+// clientGone reports whether err comes from the client cancelling the
+// request rather than from the backend or a deadline.
+func clientGone(req *http.Request, err error) bool {
+	return errors.Is(err, context.Canceled) && errors.Is(req.Context().Err(), context.Canceled)
+}
+
+// statusForError picks the status returned to the client when a proxy
+// attempt produced no response.
+func statusForError(req *http.Request, err error) int {
+	switch {
+	case clientGone(req, err):
+		return statusClientClosedRequest
+	case classifyProxyError(err) == "timeout":
+		return http.StatusGatewayTimeout
+	default:
+		return http.StatusBadGateway
+	}
+}
@@ -0,0 +1,486 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/shashankk204/load_balancer/pkg/logger"
+)
+
+// TrafficSplitConfig divides a route between named backend groups, e.g. a
+// stable and a canary release. The first group is the baseline and receives
+// whatever percentage the other groups leave over.
+type TrafficSplitConfig struct {
+	Groups         []GroupConfig `json:"groups"`
+	OverrideHeader string        `json:"override_header,omitempty"` // header naming the group to force
+	OverrideCookie string        `json:"override_cookie,omitempty"` // cookie naming the group to force
+	StickyKey      string        `json:"sticky_key,omitempty"`      // "ip" (default), "header:<name>", "cookie:<name>", "param:<name>" or "query:<name>"
+}
+
+type GroupConfig struct {
+	Name     string          `json:"name"`
+	Backends []BackendConfig `json:"backends"`
+	Percent  int             `json:"percent,omitempty"` // ignored for the baseline group
+}
+
+// BackendGroup is one group of a split route. Its Pool shares *Backend
+// values with the route's pool, so health and counters are common to both.
+type BackendGroup struct {
+	Name    string
+	Pool    *BackendPool
+	percent int32
+}
+
+func (g *BackendGroup) Percent() int {
+	return int(atomic.LoadInt32(&g.percent))
+}
+
+// TrafficSplit is the runtime state of a split route.
+type TrafficSplit struct {
+	Config *TrafficSplitConfig
+	Groups []*BackendGroup
+
+	ramp *rampSlot // shared with the copies admin changes make of the split
+}
+
+// errRampReplaced stops a ramp whose route was changed or given a new ramp.
+var errRampReplaced = errors.New("canary ramp was replaced")
+
+// rampSlot holds the canary ramp of a split route.
+type rampSlot struct {
+	mu    sync.Mutex // guards state
+	state *rampState
+}
+
+// newTrafficSplit builds the groups of a split route. The returned backends
+// are the union of all groups, deduplicated by URL, for the route's own pool.
+func newTrafficSplit(cfg *TrafficSplitConfig, newBackend func(BackendConfig) (*Backend, error)) (*TrafficSplit, []*Backend, error) {
+	if len(cfg.Groups) < 2 {
+		return nil, nil, fmt.Errorf("traffic split needs at least two groups")
+	}
+	split := &TrafficSplit{Config: cfg, ramp: &rampSlot{}}
+	byURL := map[string]*Backend{}
+	var all []*Backend
+	total := 0
+	for i, gc := range cfg.Groups {
+		if gc.Name == "" {
+			return nil, nil, fmt.Errorf("traffic split group %d has no name", i+1)
+		}
+		if split.Group(gc.Name) != nil {
+			return nil, nil, fmt.Errorf("duplicate traffic split group %s", gc.Name)
+		}
+		if len(gc.Backends) == 0 {
+			return nil, nil, fmt.Errorf("traffic split group %s has no backends", gc.Name)
+		}
+		if i > 0 {
+			if gc.Percent < 0 || gc.Percent > 100 {
+				return nil, nil, fmt.Errorf("traffic split group %s: percent must be between 0 and 100", gc.Name)
+			}
+			total += gc.Percent
+		}
+		pool := &BackendPool{}
+		for _, bc := range gc.Backends {
+			b, ok := byURL[bc.URL]
+			if !ok {
+				var err error
+				if b, err = newBackend(bc); err != nil {
+					return nil, nil, fmt.Errorf("traffic split group %s: %w", gc.Name, err)
+				}
+				byURL[bc.URL] = b
+				all = append(all, b)
+			}
+			pool.Backends = append(pool.Backends, b)
+		}
+		g := &BackendGroup{Name: gc.Name, Pool: pool}
+		if i > 0 {
+			g.percent = int32(gc.Percent)
+		}
+		split.Groups = append(split.Groups, g)
+	}
+	if total > 100 {
+		return nil, nil, fmt.Errorf("traffic split percentages add up to %d, more than 100", total)
+	}
+	return split, all, nil
+}
+
+// clone copies the split and its group pools for a changed route pool. The
+// ramp carries over.
+func (s *TrafficSplit) clone() *TrafficSplit {
+	c := &TrafficSplit{Config: s.Config, ramp: s.ramp}
+	for _, g := range s.Groups {
+		c.Groups = append(c.Groups, &BackendGroup{
+			Name:    g.Name,
+			Pool:    &BackendPool{Backends: slices.Clone(g.Pool.Backends)},
+			percent: int32(g.Percent()),
+		})
+	}
+	return c
+}
+
+// inherit copies the route's selection settings into every group pool.
+func (s *TrafficSplit) inherit(route *BackendPool) {
+	for _, g := range s.Groups {
+		g.Pool.Prefix = route.Prefix
+		g.Pool.Strategy = route.Strategy
+		g.Pool.Retry = route.Retry
+		g.Pool.CircuitBreaker = route.CircuitBreaker
+		g.Pool.Outlier = route.Outlier
+		g.Pool.Hash = route.Hash
+		g.Pool.Sticky = route.Sticky
+		g.Pool.Latency = route.Latency
+		g.Pool.SlowStart = route.SlowStart
+		g.Pool.ErrorPages = route.ErrorPages
+	}
+}
+
+func (s *TrafficSplit) Group(name string) *BackendGroup {
+	for _, g := range s.Groups {
+		if g.Name == name {
+			return g
+		}
+	}
+	return nil
+}
+
+func (s *TrafficSplit) baseline() *BackendGroup {
+	return s.Groups[0]
+}
+
+// SetPercent changes the share of a non-baseline group.
+func (s *TrafficSplit) SetPercent(name string, percent int) error {
+	g := s.Group(name)
+	if g == nil {
+		return fmt.Errorf("unknown group %s", name)
+	}
+	if g == s.baseline() {
+		return fmt.Errorf("group %s is the baseline and receives the remaining traffic", name)
+	}
+	if percent < 0 || percent > 100 {
+		return fmt.Errorf("percent must be between 0 and 100")
+	}
+	others := 0
+	for _, o := range s.Groups[1:] {
+		if o != g {
+			others += o.Percent()
+		}
+	}
+	if others+percent > 100 {
+		return fmt.Errorf("percent %d would bring the split to %d", percent, others+percent)
+	}
+	atomic.StoreInt32(&g.percent, int32(percent))
+	return nil
+}
+
+// Pick chooses the group for a request: an explicit override first, then a
+// bucket derived from the sticky key so the same user keeps landing in the
+// same group while percentages only grow.
+func (s *TrafficSplit) Pick(req *http.Request, clientIP string) *BackendGroup {
+	if g := s.override(req); g != nil {
+		return g
+	}
+	bucket := int(stickyHash(requestKey(s.Config.StickyKey, req, clientIP)) % 100)
+	acc := 0
+	for _, g := range s.Groups[1:] {
+		acc += g.Percent()
+		if bucket < acc {
+			if g.Pool.HasSelectable() {
+				return g
+			}
+			break
+		}
+	}
+	return s.baseline()
+}
+
+func (s *TrafficSplit) override(req *http.Request) *BackendGroup {
+	if h := s.Config.OverrideHeader; h != "" {
+		if g := s.Group(req.Header.Get(h)); g != nil {
+			return g
+		}
+	}
+	if c := s.Config.OverrideCookie; c != "" {
+		if cookie, err := req.Cookie(c); err == nil {
+			if g := s.Group(cookie.Value); g != nil {
+				return g
+			}
+		}
+	}
+	return nil
+}
+
+func stickyHash(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return h.Sum32()
+}
+
+// CanaryRamp describes a progressive rollout of one group.
+type CanaryRamp struct {
+	Group         string   `json:"group"`
+	StartPercent  int      `json:"start_percent"`
+	StepPercent   int      `json:"step_percent"`
+	TargetPercent int      `json:"target_percent,omitempty"` // defaults to 100
+	Interval      Duration `json:"interval"`
+	MaxErrorRate  float64  `json:"max_error_rate"`         // 5xx share that triggers a rollback, e.g. 0.05
+	MinRequests   int      `json:"min_requests,omitempty"` // requests per interval before the rate is judged
+}
+
+type rampState struct {
+	Ramp   CanaryRamp `json:"ramp"`
+	State  string     `json:"state"` // running, completed, rolled_back, cancelled
+	Reason string     `json:"reason,omitempty"`
+	cancel context.CancelFunc
+}
+
+func (r *CanaryRamp) validate(s *TrafficSplit) error {
+	g := s.Group(r.Group)
+	if g == nil {
+		return fmt.Errorf("unknown group %s", r.Group)
+	}
+	if g == s.baseline() {
+		return fmt.Errorf("cannot ramp the baseline group %s", r.Group)
+	}
+	if r.TargetPercent == 0 {
+		r.TargetPercent = 100
+	}
+	if r.StepPercent <= 0 || r.Interval <= 0 {
+		return fmt.Errorf("step_percent and interval must be positive")
+	}
+	if r.StartPercent < 0 || r.StartPercent > r.TargetPercent || r.TargetPercent > 100 {
+		return fmt.Errorf("need 0 <= start_percent <= target_percent <= 100")
+	}
+	return nil
+}
+
+// StartCanaryRamp begins ramping a group of a split route, replacing any ramp
+// already running on it. Every interval the group's 5xx rate is read from
+// BackendRequestsTotal; above MaxErrorRate the group is rolled back to 0%.
+func (lb *LoadBalancer) StartCanaryRamp(route string, ramp CanaryRamp) error {
+	lb.mux.RLock()
+	pool, ok := lb.Routes[route]
+	lb.mux.RUnlock()
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrRouteNotFound, route)
+	}
+	split := pool.Split
+	if split == nil {
+		return fmt.Errorf("route %s has no traffic split", route)
+	}
+	if err := ramp.validate(split); err != nil {
+		return err
+	}
+	if err := lb.setGroupPercent(route, ramp.Group, ramp.StartPercent, nil); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	state := &rampState{Ramp: ramp, State: "running", cancel: cancel}
+	slot := split.ramp
+	slot.mu.Lock()
+	if slot.state != nil && slot.state.State == "running" {
+		slot.state.cancel()
+		slot.state.State = "cancelled"
+	}
+	slot.state = state
+	slot.mu.Unlock()
+
+	go lb.runCanaryRamp(ctx, route, split, state)
+	return nil
+}
+
+// splitOf returns the current split of route. Admin changes to the route
+// replace it with a copy while a ramp is running.
+func (lb *LoadBalancer) splitOf(route string) *TrafficSplit {
+	lb.mux.RLock()
+	defer lb.mux.RUnlock()
+	if pool, ok := lb.Routes[route]; ok {
+		return pool.Split
+	}
+	return nil
+}
+
+func (lb *LoadBalancer) runCanaryRamp(ctx context.Context, route string, split *TrafficSplit, state *rampState) {
+	ramp := state.Ramp
+	slot := split.ramp
+	group := split.Group(ramp.Group)
+	logCtx := logger.WithRequestID(context.Background())
+	urls := make([]string, 0, len(group.Pool.Backends))
+	for _, b := range group.Pool.Backends {
+		urls = append(urls, b.URL.String())
+	}
+
+	finish := func(result, reason string) {
+		slot.mu.Lock()
+		state.State = result
+		state.Reason = reason
+		slot.mu.Unlock()
+		fields := map[string]string{
+			"route":  route,
+			"group":  ramp.Group,
+			"state":  result,
+			"reason": reason,
+		}
+		if result == "rolled_back" {
+			logger.Error(logCtx, "Canary ramp rolled back", fields)
+			return
+		}
+		logger.Info(logCtx, "Canary ramp finished", fields)
+	}
+
+	lastTotal, lastErrors := backendRequestCounts(route, urls)
+	ticker := time.NewTicker(time.Duration(ramp.Interval))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if split = lb.splitOf(route); split == nil || split.ramp != slot {
+			return // the route was removed or rebuilt, which cancelled the ramp
+		}
+		group = split.Group(ramp.Group)
+
+		total, errors := backendRequestCounts(route, urls)
+		dTotal, dErrors := total-lastTotal, errors-lastErrors
+		lastTotal, lastErrors = total, errors
+
+		judged := dTotal > 0 && dTotal >= float64(ramp.MinRequests)
+		if judged && dErrors/dTotal > ramp.MaxErrorRate {
+			if err := lb.rampTo(logCtx, route, ramp.Group, 0, slot); err != nil {
+				return // replaced meanwhile
+			}
+			CanaryRollbacksTotal.WithLabelValues(route, ramp.Group).Inc()
+			finish("rolled_back", fmt.Sprintf("5xx rate %.3f above %.3f", dErrors/dTotal, ramp.MaxErrorRate))
+			return
+		}
+
+		current := group.Percent()
+		if current >= ramp.TargetPercent {
+			finish("completed", "")
+			return
+		}
+		if !judged {
+			continue // not enough traffic to vouch for the next step
+		}
+		next := min(current+ramp.StepPercent, ramp.TargetPercent)
+		if err := lb.rampTo(logCtx, route, ramp.Group, next, slot); err != nil {
+			if err != errRampReplaced {
+				finish("cancelled", err.Error())
+			}
+			return
+		}
+		logger.Info(logCtx, "Canary ramp step", map[string]string{
+			"route":   route,
+			"group":   ramp.Group,
+			"percent": strconv.Itoa(next),
+		})
+	}
+}
+
+// rampTo moves the ramped group to percent and records that like an admin
+// change, so the config, the history and the persisted file show the group's
+// current share. Failing to record it is logged; the step still counts.
+func (lb *LoadBalancer) rampTo(ctx context.Context, route, group string, percent int, slot *rampSlot) error {
+	action := fmt.Sprintf("ramp-canary %s to %d%%", group, percent)
+	_, err := lb.Change("canary-ramp", action, func() error {
+		return lb.setGroupPercent(route, group, percent, slot)
+	})
+	var persistErr *PersistError
+	if errors.As(err, &persistErr) {
+		logger.Error(ctx, "Failed to persist canary ramp step", map[string]string{
+			"route": route,
+			"group": group,
+			"error": err.Error(),
+		})
+		return nil
+	}
+	return err
+}
+
+// StopCanaryRamp cancels a running ramp, leaving the current percentage.
+func (s *TrafficSplit) StopCanaryRamp() {
+	s.ramp.mu.Lock()
+	defer s.ramp.mu.Unlock()
+	if s.ramp.state != nil && s.ramp.state.State == "running" {
+		s.ramp.state.cancel()
+		s.ramp.state.State = "cancelled"
+	}
+}
+
+// Info describes the split for the admin API.
+func (s *TrafficSplit) Info() map[string]interface{} {
+	groups := make([]map[string]interface{}, 0, len(s.Groups))
+	rest := 100
+	for _, g := range s.Groups[1:] {
+		rest -= g.Percent()
+	}
+	for i, g := range s.Groups {
+		percent := g.Percent()
+		if i == 0 {
+			percent = rest
+		}
+		var urls []string
+		for _, b := range g.Pool.Backends {
+			urls = append(urls, b.URL.String())
+		}
+		groups = append(groups, map[string]interface{}{
+			"name":     g.Name,
+			"percent":  percent,
+			"backends": urls,
+		})
+	}
+	info := map[string]interface{}{"groups": groups}
+	s.ramp.mu.Lock()
+	if s.ramp.state != nil {
+		info["ramp"] = *s.ramp.state
+	}
+	s.ramp.mu.Unlock()
+	return info
+}
+
+// backendRequestCounts sums lb_backend_requests_total for the given backends
+// of a route, returning all requests and those that ended in a 5xx.
+func backendRequestCounts(route string, urls []string) (total, errors float64) {
+	wanted := make(map[string]bool, len(urls))
+	for _, u := range urls {
+		wanted[u] = true
+	}
+	ch := make(chan prometheus.Metric)
+	go func() {
+		BackendRequestsTotal.Collect(ch)
+		close(ch)
+	}()
+	for m := range ch {
+		var pb dto.Metric
+		if err := m.Write(&pb); err != nil {
+			continue
+		}
+		labels := map[string]string{}
+		for _, l := range pb.GetLabel() {
+			labels[l.GetName()] = l.GetValue()
+		}
+		if labels["route"] != route || !wanted[labels["backend"]] {
+			continue
+		}
+		v := pb.GetCounter().GetValue()
+		total += v
+		if strings.HasPrefix(labels["status_code"], "5") {
+			errors += v
+		}
+	}
+	return total, errors
+}
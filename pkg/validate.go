@@ -0,0 +1,477 @@
+package core
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"go.yaml.in/yaml/v3"
+)
+
+// ConfigProblem is one thing wrong with a config, at a location such as
+// routes[2].backends[0].
+type ConfigProblem struct {
+	Location string `json:"location"`
+	Message  string `json:"message"`
+}
+
+func (p ConfigProblem) String() string {
+	if p.Location == "" {
+		return p.Message
+	}
+	return p.Location + ": " + p.Message
+}
+
+// ConfigError lists every problem found in a config.
+type ConfigError struct {
+	File     string
+	Problems []ConfigProblem
+}
+
+func (e *ConfigError) Error() string {
+	var b strings.Builder
+	if e.File != "" {
+		b.WriteString(e.File + ": ")
+	}
+	if len(e.Problems) == 1 {
+		b.WriteString(e.Problems[0].String())
+		return b.String()
+	}
+	fmt.Fprintf(&b, "%d problems", len(e.Problems))
+	for _, p := range e.Problems {
+		b.WriteString("\n  " + p.String())
+	}
+	return b.String()
+}
+
+type problems []ConfigProblem
+
+func (ps *problems) add(location, format string, args ...any) {
+	*ps = append(*ps, ConfigProblem{Location: location, Message: fmt.Sprintf(format, args...)})
+}
+
+// sortByRoute orders problems by the route they are in, keeping the order
+// they were found in otherwise.
+func (ps problems) sortByRoute() {
+	route := func(p ConfigProblem) int {
+		var i int
+		if _, err := fmt.Sscanf(p.Location, "routes[%d]", &i); err != nil {
+			return -1
+		}
+		return i
+	}
+	slices.SortStableFunc(ps, func(a, b ConfigProblem) int { return cmp.Compare(route(a), route(b)) })
+}
+
+// configFormat picks the config format from the file extension: YAML for
+// .yaml and .yml, TOML for .toml and JSON for anything else.
+func configFormat(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return "yaml"
+	case ".toml":
+		return "toml"
+	default:
+		return "json"
+	}
+}
+
+// ParseConfig decodes and validates a config in format, "json", "yaml" or
+// "toml". Unknown fields are errors. All problems found are returned together
+// in a *ConfigError; syntax errors are returned on their own.
+func ParseConfig(data []byte, format string) (*Config, error) {
+	top, err := decodeObject(data, format)
+	if err != nil {
+		return nil, err
+	}
+
+	var ps problems
+	checkFields(top, reflect.TypeOf(Config{}), "", &ps)
+
+	// Routes are decoded one at a time so that every broken route is reported.
+	cfg := &Config{}
+	rest := maps.Clone(top)
+	delete(rest, "routes")
+	decodeValue(rest, cfg, "", &ps)
+	routes, ok := top["routes"].([]any)
+	if !ok && top["routes"] != nil {
+		ps.add("routes", "must be a list")
+	}
+	broken := make(map[int]bool)
+	for i, r := range routes {
+		var rc RouteConfig
+		if !decodeValue(r, &rc, fmt.Sprintf("routes[%d]", i), &ps) {
+			broken[i] = true
+		}
+		cfg.Routes = append(cfg.Routes, rc)
+	}
+
+	ps = append(ps, validateConfig(cfg, broken)...)
+	if len(ps) > 0 {
+		ps.sortByRoute()
+		return nil, &ConfigError{Problems: ps}
+	}
+	return cfg, nil
+}
+
+// decodeObject decodes a JSON, YAML or TOML document whose top level must be
+// an object into the types encoding/json uses.
+func decodeObject(data []byte, format string) (map[string]any, error) {
+	var raw any
+	var err error
+	switch format {
+	case "yaml":
+		err = yaml.Unmarshal(data, &raw)
+	case "toml":
+		var table map[string]any
+		_, err = toml.Decode(string(data), &table)
+		raw = table
+	default:
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.UseNumber()
+		err = dec.Decode(&raw)
+	}
+	if err != nil {
+		return nil, err
+	}
+	top, ok := normalize(raw).(map[string]any)
+	if !ok {
+		return nil, &ConfigError{Problems: []ConfigProblem{{Message: "expected an object at the top level"}}}
+	}
+	return top, nil
+}
+
+// DecodeConfigFile decodes the file at path into out, in the format of its
+// extension, and fails on unknown fields and values of the wrong type like
+// the routes config does. Problems are returned as a *ConfigError.
+func DecodeConfigFile(path string, out any) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	err = decodeStrict(data, configFormat(path), out)
+	var cfgErr *ConfigError
+	if errors.As(err, &cfgErr) {
+		cfgErr.File = path
+		return cfgErr
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+// decodeStrict decodes data into out, rejecting unknown fields and values of
+// the wrong type.
+func decodeStrict(data []byte, format string, out any) error {
+	top, err := decodeObject(data, format)
+	if err != nil {
+		return err
+	}
+	var ps problems
+	checkFields(top, reflect.TypeOf(out), "", &ps)
+	decodeValue(top, out, "", &ps)
+	if len(ps) > 0 {
+		return &ConfigError{Problems: ps}
+	}
+	return nil
+}
+
+// normalize turns what the YAML and TOML decoders produce into the types
+// encoding/json uses.
+func normalize(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for k, e := range v {
+			v[k] = normalize(e)
+		}
+		return v
+	case map[any]any:
+		m := make(map[string]any, len(v))
+		for k, e := range v {
+			m[fmt.Sprint(k)] = normalize(e)
+		}
+		return m
+	case []any:
+		for i := range v {
+			v[i] = normalize(v[i])
+		}
+		return v
+	case []map[string]any:
+		out := make([]any, len(v))
+		for i, e := range v {
+			out[i] = normalize(e)
+		}
+		return out
+	}
+	return v
+}
+
+// decodeValue decodes v into out through its JSON form, so that every format
+// shares the JSON field names and decoding rules. Failures already reported
+// by checkFields under location are not reported again.
+func decodeValue(v any, out any, location string, ps *problems) bool {
+	data, err := json.Marshal(v)
+	if err == nil {
+		err = json.Unmarshal(data, out)
+	}
+	if err == nil {
+		return true
+	}
+	for _, p := range *ps {
+		if location == "" || p.Location == location || strings.HasPrefix(p.Location, location+".") || strings.HasPrefix(p.Location, location+"[") {
+			return false
+		}
+	}
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) && typeErr.Field != "" {
+		ps.add(joinLocation(location, typeErr.Field), "expected %s, got %s", typeErr.Type, typeErr.Value)
+	} else {
+		ps.add(location, "%v", err)
+	}
+	return false
+}
+
+var jsonUnmarshaler = reflect.TypeFor[json.Unmarshaler]()
+
+// checkFields reports keys of v that t has no JSON field for and values of
+// the wrong type, each at its exact location.
+func checkFields(v any, t reflect.Type, location string, ps *problems) {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if v == nil {
+		return
+	}
+	if t.Kind() != reflect.Struct && reflect.PointerTo(t).Implements(jsonUnmarshaler) {
+		// Types with their own decoding, such as Duration.
+		decodeValue(v, reflect.New(t).Interface(), location, ps)
+		return
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		m, ok := v.(map[string]any)
+		if !ok {
+			if _, isString := v.(string); !isString || !reflect.PointerTo(t).Implements(jsonUnmarshaler) {
+				ps.add(location, "expected an object, got %s", describe(v))
+			}
+			return // a BackendConfig may be a plain URL
+		}
+		fields := jsonFields(t)
+		for _, key := range slices.Sorted(maps.Keys(m)) {
+			ft, ok := fields[key]
+			if !ok {
+				ps.add(joinLocation(location, key), "unknown field")
+				continue
+			}
+			checkFields(m[key], ft, joinLocation(location, key), ps)
+		}
+	case reflect.Slice:
+		list, ok := v.([]any)
+		if !ok {
+			ps.add(location, "expected a list, got %s", describe(v))
+		}
+		for i, e := range list {
+			checkFields(e, t.Elem(), fmt.Sprintf("%s[%d]", location, i), ps)
+		}
+	case reflect.Map:
+		m, ok := v.(map[string]any)
+		if !ok {
+			ps.add(location, "expected an object, got %s", describe(v))
+		}
+		for _, key := range slices.Sorted(maps.Keys(m)) {
+			checkFields(m[key], t.Elem(), joinLocation(location, key), ps)
+		}
+	case reflect.String:
+		if _, ok := v.(string); !ok {
+			ps.add(location, "expected a string, got %s", describe(v))
+		}
+	case reflect.Bool:
+		if _, ok := v.(bool); !ok {
+			ps.add(location, "expected true or false, got %s", describe(v))
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if !isWholeNumber(v) {
+			ps.add(location, "expected a whole number, got %s", describe(v))
+		}
+	case reflect.Float32, reflect.Float64:
+		if describe(v) != "a number" {
+			ps.add(location, "expected a number, got %s", describe(v))
+		}
+	}
+}
+
+func isWholeNumber(v any) bool {
+	switch v := v.(type) {
+	case json.Number:
+		_, err := v.Int64()
+		return err == nil
+	case int, int64, uint64:
+		return true
+	case float64:
+		return v == float64(int64(v))
+	}
+	return false
+}
+
+func describe(v any) string {
+	switch v := v.(type) {
+	case string:
+		return fmt.Sprintf("%q", v)
+	case bool:
+		return fmt.Sprint(v)
+	case json.Number, int, int64, uint64, float64:
+		return "a number"
+	case []any:
+		return "a list"
+	case map[string]any:
+		return "an object"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+func jsonFields(t reflect.Type) map[string]reflect.Type {
+	fields := make(map[string]reflect.Type)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+			maps.Copy(fields, jsonFields(f.Type))
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		fields[name] = f.Type
+	}
+	return fields
+}
+
+func joinLocation(location, key string) string {
+	if location == "" {
+		return key
+	}
+	return location + "." + key
+}
+
+// Validate checks cfg and returns a *ConfigError listing every problem, or
+// nil if the config can be applied.
+func (cfg *Config) Validate() error {
+	if ps := validateConfig(cfg, nil); len(ps) > 0 {
+		return &ConfigError{Problems: ps}
+	}
+	return nil
+}
+
+// validateConfig checks every route except the broken ones, which could not
+// be decoded.
+func validateConfig(cfg *Config, broken map[int]bool) problems {
+	var ps problems
+	if _, err := NewErrorPages(cfg.ErrorPages); err != nil {
+		ps.add("error_pages", "%v", err)
+	}
+	keys := make(map[string]int)
+	unconditional := make(map[string]int)
+	trie := NewTrie() // catches prefixes that cannot share the routing trie
+	for i, r := range cfg.Routes {
+		if broken[i] {
+			continue
+		}
+		loc := fmt.Sprintf("routes[%d]", i)
+		found := len(ps)
+
+		switch {
+		case r.Prefix == "":
+			ps.add(loc+".prefix", "is required")
+		case !strings.HasPrefix(r.Prefix, "/"):
+			ps.add(loc+".prefix", "must start with /")
+		default:
+			if err := trie.Insert(r.Prefix); err != nil {
+				ps.add(loc+".prefix", "%v", err)
+			}
+		}
+		if r.Match != nil && r.Name == "" {
+			ps.add(loc+".name", "is required when match is set")
+		}
+		if r.Match != nil {
+			validateValueMatches(r.Match.Headers, loc+".match.headers", &ps)
+			validateValueMatches(r.Match.Query, loc+".match.query", &ps)
+		}
+		if j, dup := keys[r.Key()]; dup {
+			ps.add(loc, "duplicate route %s, also defined at routes[%d]", r.Key(), j)
+		} else {
+			keys[r.Key()] = i
+			if r.Match == nil && r.Prefix != "" {
+				if j, dup := unconditional[r.Prefix]; dup {
+					ps.add(loc+".prefix", "duplicate prefix %s, routes[%d] already takes all its requests", r.Prefix, j)
+				} else {
+					unconditional[r.Prefix] = i
+				}
+			}
+		}
+		if _, ok := LookupStrategy(r.Strategy); !ok {
+			ps.add(loc+".strategy", "unknown strategy %q", r.Strategy)
+		}
+
+		if r.TrafficSplit == nil && len(r.Backends) == 0 {
+			ps.add(loc+".backends", "route has no backends")
+		}
+		validateBackends(r.Backends, loc+".backends", &ps)
+		if r.TrafficSplit != nil {
+			for g, gc := range r.TrafficSplit.Groups {
+				gloc := fmt.Sprintf("%s.traffic_split.groups[%d].backends", loc, g)
+				if len(gc.Backends) == 0 {
+					ps.add(gloc, "group has no backends")
+				}
+				validateBackends(gc.Backends, gloc, &ps)
+			}
+		}
+
+		if len(ps) == found {
+			// The remaining rules are checked by building the route.
+			if _, _, err := newPool(r, nil); err != nil {
+				ps.add(loc, "%v", err)
+			}
+		}
+	}
+	return ps
+}
+
+func validateValueMatches(matches []ValueMatch, location string, ps *problems) {
+	for i, m := range matches {
+		if err := m.check(); err != nil {
+			ps.add(fmt.Sprintf("%s[%d]", location, i), "%v", err)
+		}
+	}
+}
+
+func validateBackends(backends []BackendConfig, location string, ps *problems) {
+	seen := make(map[string]bool, len(backends))
+	for i, b := range backends {
+		loc := fmt.Sprintf("%s[%d]", location, i)
+		if _, err := ParseBackendURL(b.URL); err != nil {
+			ps.add(loc, "%v", err)
+		} else if seen[b.URL] {
+			ps.add(loc, "duplicate backend %s", b.URL)
+		}
+		seen[b.URL] = true
+		if b.Weight < 0 {
+			ps.add(loc+".weight", "must not be negative")
+		}
+	}
+}
@@ -0,0 +1,401 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/shashankk204/load_balancer/pkg/logger"
+)
+
+// Webhook event types.
+const (
+	EventBackendUp     = "backend.up"
+	EventBackendDown   = "backend.down"
+	EventCircuitOpen   = "circuit.open"
+	EventCircuitClosed = "circuit.closed"
+	EventRouteDown     = "route.down" // no backend of the route passes its health checks
+	EventRouteUp       = "route.up"   // the first backend of a down route is back
+	EventConfigChanged = "config.changed"
+)
+
+var webhookEvents = []string{
+	EventBackendUp, EventBackendDown, EventCircuitOpen, EventCircuitClosed,
+	EventRouteDown, EventRouteUp, EventConfigChanged,
+}
+
+const (
+	webhookQueueSize = 256 // events a webhook may fall behind before new ones are dropped
+
+	// Headers of a webhook request.
+	HeaderWebhookID        = "X-LB-Webhook-ID"
+	HeaderWebhookEvent     = "X-LB-Webhook-Event"
+	HeaderWebhookTimestamp = "X-LB-Webhook-Timestamp"
+	HeaderWebhookSignature = "X-LB-Webhook-Signature"
+)
+
+// WebhookConfig lists the endpoints notified of state changes. It is read
+// from a file of its own so that secrets never show up in the routes config.
+type WebhookConfig struct {
+	Webhooks     []WebhookTarget `json:"webhooks"`
+	DedupeWindow Duration        `json:"dedupe_window,omitempty"` // default 1m
+}
+
+type WebhookTarget struct {
+	Name        string            `json:"name"`
+	URL         string            `json:"url"`
+	Secret      string            `json:"secret,omitempty"`       // signs each payload with HMAC-SHA256
+	Events      []string          `json:"events,omitempty"`       // all if empty
+	Routes      []string          `json:"routes,omitempty"`       // all if empty; config changes are always sent
+	Headers     map[string]string `json:"headers,omitempty"`      // e.g. Authorization
+	Timeout     Duration          `json:"timeout,omitempty"`      // per attempt, default 5s
+	MaxAttempts int               `json:"max_attempts,omitempty"` // default 5
+	Backoff     Duration          `json:"backoff,omitempty"`      // before the first retry, default 1s, doubled for each one after
+	MaxBackoff  Duration          `json:"max_backoff,omitempty"`  // default 1m
+}
+
+func LoadWebhookConfig(path string) (*WebhookConfig, error) {
+	var cfg WebhookConfig
+	if err := DecodeConfigFile(path, &cfg); err != nil {
+		return nil, err
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &cfg, nil
+}
+
+func (cfg *WebhookConfig) validate() error {
+	if cfg.DedupeWindow < 0 {
+		return fmt.Errorf("dedupe_window must not be negative")
+	}
+	names := make(map[string]bool, len(cfg.Webhooks))
+	for _, t := range cfg.Webhooks {
+		if t.Name == "" {
+			return fmt.Errorf("webhook %s: name is required", t.URL)
+		}
+		if names[t.Name] {
+			return fmt.Errorf("webhook %s: duplicate name", t.Name)
+		}
+		names[t.Name] = true
+		u, err := url.Parse(t.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("webhook %s: url must be an absolute http or https URL", t.Name)
+		}
+		for _, ev := range t.Events {
+			if !slices.Contains(webhookEvents, ev) {
+				return fmt.Errorf("webhook %s: unknown event %q", t.Name, ev)
+			}
+		}
+		if t.Timeout < 0 || t.Backoff < 0 || t.MaxBackoff < 0 || t.MaxAttempts < 0 {
+			return fmt.Errorf("webhook %s: timeout, max_attempts and backoff must not be negative", t.Name)
+		}
+	}
+	return nil
+}
+
+func (cfg *WebhookConfig) dedupeWindow() time.Duration {
+	if cfg.DedupeWindow > 0 {
+		return time.Duration(cfg.DedupeWindow)
+	}
+	return time.Minute
+}
+
+func (t *WebhookTarget) wants(ev *WebhookEvent) bool {
+	if len(t.Events) > 0 && !slices.Contains(t.Events, ev.Type) {
+		return false
+	}
+	return len(t.Routes) == 0 || ev.Route == "" || slices.Contains(t.Routes, ev.Route)
+}
+
+// retryDelay is the wait before attempt n+1, n counting from 1.
+func (t *WebhookTarget) retryDelay(n int) time.Duration {
+	d, limit := time.Second, time.Minute
+	if t.Backoff > 0 {
+		d = time.Duration(t.Backoff)
+	}
+	if t.MaxBackoff > 0 {
+		limit = time.Duration(t.MaxBackoff)
+	}
+	for i := 1; i < n && d < limit; i++ {
+		d *= 2
+	}
+	return min(d, limit)
+}
+
+// WebhookEvent is the JSON body of a webhook request.
+type WebhookEvent struct {
+	ID      string        `json:"id"` // the same on every retry, for receivers to drop repeats
+	Type    string        `json:"type"`
+	Time    time.Time     `json:"time"`
+	Route   string        `json:"route,omitempty"`
+	Backend string        `json:"backend,omitempty"`
+	Reason  string        `json:"reason,omitempty"`
+	Config  *ConfigChange `json:"config,omitempty"` // config.changed only
+}
+
+// ConfigChange names the routes a new config version touched.
+type ConfigChange struct {
+	Version int64    `json:"version"`
+	Author  string   `json:"author"`
+	Action  string   `json:"action"`
+	Added   []string `json:"added,omitempty"`
+	Removed []string `json:"removed,omitempty"`
+	Updated []string `json:"updated,omitempty"`
+}
+
+func newConfigChange(s *Snapshot) *ConfigChange {
+	c := &ConfigChange{Version: s.Version, Author: s.Author, Action: s.Action}
+	for _, r := range s.Diff.Added {
+		c.Added = append(c.Added, r.Key())
+	}
+	for _, r := range s.Diff.Removed {
+		c.Removed = append(c.Removed, r.Key())
+	}
+	for _, u := range s.Diff.Updated {
+		c.Updated = append(c.Updated, u.Route)
+	}
+	return c
+}
+
+// subject is what an event reports the state of; config changes have none.
+func (ev *WebhookEvent) subject() string {
+	switch ev.Type {
+	case EventBackendUp, EventBackendDown:
+		return "backend " + ev.Route + " " + ev.Backend
+	case EventCircuitOpen, EventCircuitClosed:
+		return "circuit " + ev.Route + " " + ev.Backend
+	case EventRouteDown, EventRouteUp:
+		return "route " + ev.Route
+	}
+	return ""
+}
+
+// Webhooks sends events to the configured endpoints, one queue and worker
+// per endpoint so that a slow one does not hold up the others. A nil
+// *Webhooks sends nothing.
+type Webhooks struct {
+	cfg    *WebhookConfig
+	client *http.Client
+
+	mu     sync.Mutex
+	last   map[string]sentState // by event subject, for de-duplication
+	queues []chan *WebhookEvent
+	closed bool
+
+	ctx    context.Context // cancelled when Close gives up waiting
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+type sentState struct {
+	typ  string
+	time time.Time
+}
+
+func NewWebhooks(cfg *WebhookConfig) *Webhooks {
+	w := &Webhooks{
+		cfg:    cfg,
+		client: &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }},
+		last:   make(map[string]sentState),
+	}
+	w.ctx, w.cancel = context.WithCancel(context.Background())
+	for i := range cfg.Webhooks {
+		queue := make(chan *WebhookEvent, webhookQueueSize)
+		w.queues = append(w.queues, queue)
+		w.wg.Add(1)
+		go w.run(&cfg.Webhooks[i], queue)
+	}
+	return w
+}
+
+// notify queues ev for every endpoint that wants it. An event repeating the
+// last state of the same backend, circuit or route within the dedupe window
+// is dropped, e.g. a circuit tripping again after a failed half-open probe.
+func (w *Webhooks) notify(ev WebhookEvent) {
+	if w == nil {
+		return
+	}
+	ev.ID = uuid.NewString()
+	if ev.Time.IsZero() {
+		ev.Time = time.Now().UTC()
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return
+	}
+	if subject := ev.subject(); subject != "" {
+		window := w.cfg.dedupeWindow()
+		for k, s := range w.last {
+			if ev.Time.Sub(s.time) >= window {
+				delete(w.last, k)
+			}
+		}
+		if s, ok := w.last[subject]; ok && s.typ == ev.Type {
+			return
+		}
+		w.last[subject] = sentState{ev.Type, ev.Time}
+	}
+	for i, queue := range w.queues {
+		t := &w.cfg.Webhooks[i]
+		if !t.wants(&ev) {
+			continue
+		}
+		select {
+		case queue <- &ev:
+		default:
+			WebhookDeliveriesTotal.WithLabelValues(t.Name, ev.Type, "dropped").Inc()
+			logger.Error(logger.WithRequestID(context.Background()), "Webhook queue full, event dropped", map[string]string{
+				"target": t.URL,
+				"event":  ev.Type,
+			})
+		}
+	}
+}
+
+// Close stops taking events and waits until ctx is done for the queued ones
+// to be delivered. Deliveries still running then are abandoned.
+func (w *Webhooks) Close(ctx context.Context) {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	if !w.closed {
+		w.closed = true
+		for _, queue := range w.queues {
+			close(queue)
+		}
+	}
+	w.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		w.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		w.cancel()
+		<-done
+	}
+}
+
+func (w *Webhooks) run(t *WebhookTarget, queue <-chan *WebhookEvent) {
+	defer w.wg.Done()
+	for ev := range queue {
+		w.deliver(t, ev)
+	}
+}
+
+// deliver sends ev to t, retrying with exponential backoff on transport
+// errors, 408, 429 and 5xx responses.
+func (w *Webhooks) deliver(t *WebhookTarget, ev *WebhookEvent) {
+	logCtx := logger.WithRequestID(context.Background())
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+	attempts := t.MaxAttempts
+	if attempts == 0 {
+		attempts = 5
+	}
+	start := time.Now()
+	for n := 1; ; n++ {
+		retry, err := w.send(t, ev, body)
+		if err == nil {
+			WebhookDeliveriesTotal.WithLabelValues(t.Name, ev.Type, "delivered").Inc()
+			return
+		}
+		if !retry || n == attempts {
+			WebhookDeliveriesTotal.WithLabelValues(t.Name, ev.Type, "failed").Inc()
+			logger.Error(logCtx, "Webhook delivery failed", map[string]string{
+				"target":   t.URL,
+				"event":    ev.Type,
+				"duration": time.Since(start).String(),
+				"error":    fmt.Sprintf("attempt %d of %d: %v", n, attempts, err),
+			})
+			return
+		}
+		timer := time.NewTimer(t.retryDelay(n))
+		select {
+		case <-w.ctx.Done():
+			timer.Stop()
+			WebhookDeliveriesTotal.WithLabelValues(t.Name, ev.Type, "failed").Inc()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+func (w *Webhooks) send(t *WebhookTarget, ev *WebhookEvent, body []byte) (retry bool, err error) {
+	timeout := 5 * time.Second
+	if t.Timeout > 0 {
+		timeout = time.Duration(t.Timeout)
+	}
+	ctx, cancel := context.WithTimeout(w.ctx, timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	for k, v := range t.Headers {
+		req.Header.Set(k, v)
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderWebhookID, ev.ID)
+	req.Header.Set(HeaderWebhookEvent, ev.Type)
+	req.Header.Set(HeaderWebhookTimestamp, timestamp)
+	if t.Secret != "" {
+		req.Header.Set(HeaderWebhookSignature, "sha256="+WebhookSignature(t.Secret, timestamp, body))
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusRequestTimeout, resp.StatusCode == http.StatusTooManyRequests, resp.StatusCode >= 500:
+		return true, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return false, fmt.Errorf("unexpected status %d", resp.StatusCode)
+}
+
+// WebhookSignature is the hex HMAC-SHA256 under secret of the unix timestamp
+// sent in X-LB-Webhook-Timestamp, a newline and the request body.
+func WebhookSignature(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "\n"))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// EnableWebhooks starts sending events to the endpoints in cfg. It must be
+// called before health checks and the listeners start.
+func (lb *LoadBalancer) EnableWebhooks(cfg *WebhookConfig) {
+	lb.webhooks = NewWebhooks(cfg)
+}
+
+// CloseWebhooks delivers the queued webhook events, giving up when ctx is done.
+func (lb *LoadBalancer) CloseWebhooks(ctx context.Context) {
+	lb.webhooks.Close(ctx)
+}